@@ -2,9 +2,12 @@ package api
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"myblockchain/core"
 	"myblockchain/types"
 	"net/http"
+	"sort"
 	"strconv"
 
 	"github.com/go-kit/log"
@@ -21,14 +24,118 @@ type APIError struct {
 type Block struct {
 	Hash          string
 	Version       uint32
+	ChainID       uint32
 	DataHash      string
 	PrevBlockHash string
+	StateRoot     string
+	ReceiptsRoot  string
+	Proposer      string
 	Height        uint32
 	Timestamp     uint64
+	Extra         string
 	Validator     string
 	Signature     string
 	TxResponse    TxResponse
 }
+type Transaction struct {
+	Hash      string
+	Type      string
+	ChainID   uint32
+	Nonce     uint64
+	From      string
+	To        string `json:",omitempty"`
+	Value     uint64
+	Fee       uint64
+	Data      string
+	Signature string
+
+	// left out when the transaction does not expire, the time is in unix
+	// nanoseconds
+	ValidUntilHeight uint32 `json:",omitempty"`
+	ValidUntilTime   uint64 `json:",omitempty"`
+}
+type Account struct {
+	Address string
+	Balance uint64
+	Nonce   uint64
+}
+type Contract struct {
+	Address  string
+	CodeHash string
+	Owner    string
+	Height   uint32
+}
+type StorageEntry struct {
+	Key   string
+	Value string
+}
+type Receipt struct {
+	TxHash      string
+	BlockHash   string
+	BlockHeight uint32
+	TxIndex     uint32
+	Status      string
+	Error       string
+	Result      string
+	WrittenKeys []string
+	Cost        uint64
+	Fee         uint64
+}
+type TxProof struct {
+	TxHash    string
+	BlockHash string
+	DataHash  string
+	Index     uint32
+	Count     uint32
+	Hashes    []string
+}
+type StateValue struct {
+	Key    string
+	Value  string
+	Height uint32
+}
+type StateProof struct {
+	Key       string
+	Exists    bool
+	Value     string
+	BlockHash string
+	Height    uint32
+	StateRoot string
+	Siblings  []string
+	// OtherPath and OtherValueHash are the leaf the path of a key that is
+	// not set ends on.
+	OtherPath      string `json:",omitempty"`
+	OtherValueHash string `json:",omitempty"`
+}
+type KeyChange struct {
+	Key  string
+	Kind string
+	Old  string `json:",omitempty"`
+	New  string `json:",omitempty"`
+}
+type TxDiff struct {
+	TxHash  string
+	Changes []KeyChange
+}
+type StateDiff struct {
+	BlockHash string
+	Height    uint32
+	Changes   []KeyChange
+	Txs       []TxDiff
+}
+type Reorg struct {
+	Ancestor  string
+	OldBranch []string
+	NewBranch []string
+	Dropped   []string
+}
+type Event struct {
+	Type    string
+	Block   *Block   `json:",omitempty"`
+	TxHash  string   `json:",omitempty"`
+	Receipt *Receipt `json:",omitempty"`
+	Reorg   *Reorg   `json:",omitempty"`
+}
 type ServerConfig struct {
 	Logger     log.Logger
 	ListenAddr string
@@ -47,7 +154,17 @@ func NewServer(cfg ServerConfig, bc *core.BlockChain) *Server {
 func (s *Server) Start() error {
 	e := echo.New()
 	e.GET("/block/:hashorid", s.handleGetBlock)
+	e.GET("/block/:hashorid/diff", s.handleGetStateDiff)
 	e.GET("/tx/:hash", s.handleGetTx)
+	e.GET("/tx/:hash/proof", s.handleGetTxProof)
+	e.GET("/receipt/:hash", s.handleGetReceipt)
+	e.GET("/account/:address", s.handleGetAccount)
+	e.GET("/contract/:address", s.handleGetContract)
+	e.GET("/contract/:address/storage", s.handleGetContractStorage)
+	e.GET("/contract/:address/storage/:key", s.handleGetContractValue)
+	e.GET("/state/:key", s.handleGetState)
+	e.GET("/state/:key/proof", s.handleGetStateProof)
+	e.GET("/events", s.handleEvents)
 	return e.Start(s.ListenAddr)
 }
 func (s *Server) handleGetTx(c echo.Context) error {
@@ -60,29 +177,226 @@ func (s *Server) handleGetTx(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
-	return c.JSON(http.StatusOK, tx)
+	return c.JSON(http.StatusOK, intoJSONTx(tx))
+}
+func (s *Server) handleGetTxProof(c echo.Context) error {
+	hash := c.Param("hash")
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != 32 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid tx hash"})
+	}
+	proof, err := s.bc.GetTxProof(types.HashFromBytes(b))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	header, err := s.bc.GetHeaderByHash(proof.BlockHash)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, intoJSONTxProof(proof, header))
+}
+func (s *Server) handleGetReceipt(c echo.Context) error {
+	hash := c.Param("hash")
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) != 32 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid tx hash"})
+	}
+	receipt, err := s.bc.GetReceipt(types.HashFromBytes(b))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, intoJSONReceipt(receipt))
+}
+func (s *Server) handleGetAccount(c echo.Context) error {
+	addr, ok := parseAddress(c.Param("address"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid address"})
+	}
+	height, err := s.heightParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	account, err := s.bc.GetAccountAt(addr, height)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, Account{
+		Address: addr.String(),
+		Balance: account.Balance,
+		Nonce:   account.Nonce,
+	})
+}
+func (s *Server) handleGetContract(c echo.Context) error {
+	addr, ok := parseAddress(c.Param("address"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid address"})
+	}
+	contract, err := s.bc.GetContract(addr)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, Contract{
+		Address:  addr.String(),
+		CodeHash: contract.CodeHash.String(),
+		Owner:    contract.Owner.String(),
+		Height:   contract.Height,
+	})
+}
+func (s *Server) handleGetContractStorage(c echo.Context) error {
+	addr, ok := parseAddress(c.Param("address"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid address"})
+	}
+	storage, err := s.bc.GetContractStorage(addr)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	entries := make([]StorageEntry, 0, len(storage))
+	for key, value := range storage {
+		entries = append(entries, StorageEntry{Key: hex.EncodeToString([]byte(key)), Value: hex.EncodeToString(value)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return c.JSON(http.StatusOK, entries)
+}
+func (s *Server) handleGetContractValue(c echo.Context) error {
+	addr, ok := parseAddress(c.Param("address"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid address"})
+	}
+	key, err := hex.DecodeString(c.Param("key"))
+	if err != nil || len(key) == 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid key"})
+	}
+	value, err := s.bc.GetContractValue(addr, key)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, StorageEntry{Key: hex.EncodeToString(key), Value: hex.EncodeToString(value)})
+}
+func (s *Server) handleGetState(c echo.Context) error {
+	key, err := hex.DecodeString(c.Param("key"))
+	if err != nil || len(key) == 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid key"})
+	}
+	height, err := s.heightParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	value, err := s.bc.GetStateAt(key, height)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, StateValue{Key: hex.EncodeToString(key), Value: hex.EncodeToString(value), Height: height})
+}
+func (s *Server) handleGetStateProof(c echo.Context) error {
+	key, err := hex.DecodeString(c.Param("key"))
+	if err != nil || len(key) == 0 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid key"})
+	}
+	height, err := s.heightParam(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	proof, header, err := s.bc.GetStateProofAt(key, height)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, intoJSONStateProof(proof, header))
+}
+
+// handleEvents streams the chain events as server-sent events until the
+// client goes away.
+func (s *Server) handleEvents(c echo.Context) error {
+	sub := s.bc.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			event := intoJSONEvent(e)
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+	}
 }
 func (s *Server) handleGetBlock(c echo.Context) error {
-	hashOrID := c.Param("hashorid")
+	block, err := s.getBlock(c.Param("hashorid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, intoJSONBlock(block))
+}
+func (s *Server) handleGetStateDiff(c echo.Context) error {
+	block, err := s.getBlock(c.Param("hashorid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	diff, err := s.bc.GetStateDiff(block.Height)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	// the chain may have been reorganized in between
+	if diff.BlockHash != block.Hash(core.BlockHasher{}) {
+		return c.JSON(http.StatusConflict, APIError{Error: "block is no longer canonical"})
+	}
+	return c.JSON(http.StatusOK, intoJSONStateDiff(diff))
+}
+
+// getBlock returns the block with the given height or hash.
+func (s *Server) getBlock(hashOrID string) (*core.Block, error) {
 	height, err := strconv.Atoi(hashOrID)
 	// If the error is nil we can assume the height of the block is given.
 	if err == nil {
-		block, err := s.bc.GetBlock(uint32(height))
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
-		}
-		return c.JSON(http.StatusOK, intoJSONBlock(block))
+		return s.bc.GetBlock(uint32(height))
 	}
 	// otherwise assume its the hash
 	b, err := hex.DecodeString(hashOrID)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		return nil, err
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("invalid block hash")
+	}
+	return s.bc.GetBlockByHash(types.HashFromBytes(b))
+}
+
+// heightParam returns the height given by the height query parameter, the
+// height of the published state if there is none. The tip is stored before
+// its state is published, reading the state at its height would fail while
+// a block is being added.
+func (s *Server) heightParam(c echo.Context) (uint32, error) {
+	param := c.QueryParam("height")
+	if param == "" {
+		return s.bc.StateView().Header.Height, nil
 	}
-	block, err := s.bc.GetBlockByHash(types.HashFromBytes(b))
+	height, err := strconv.ParseUint(param, 10, 32)
 	if err != nil {
-		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		return 0, fmt.Errorf("invalid height %q", param)
 	}
-	return c.JSON(http.StatusOK, intoJSONBlock(block))
+	return uint32(height), nil
+}
+func parseAddress(s string) (types.Address, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(types.Address{}) {
+		return types.Address{}, false
+	}
+	return types.AddressFromBytes(b), true
 }
 func intoJSONBlock(block *core.Block) Block {
 	txResponse := TxResponse{
@@ -92,15 +406,162 @@ func intoJSONBlock(block *core.Block) Block {
 	for i := 0; i < int(txResponse.TxCount); i++ {
 		txResponse.Hashes[i] = block.Transactions[i].Hash(core.TxHasher{}).String()
 	}
+	// the genesis block is not signed, it has no validator either
+	validator, signature := "", ""
+	if block.Signature != nil {
+		validator = block.Validatar.Address().String()
+		signature = block.Signature.String()
+	}
 	return Block{
 		Hash:          block.Hash(core.BlockHasher{}).String(),
 		Version:       block.Header.Version,
+		ChainID:       block.Header.ChainID,
 		Height:        block.Header.Height,
 		DataHash:      block.Header.DataHash.String(),
 		PrevBlockHash: block.Header.PrevBlockHash.String(),
+		StateRoot:     block.Header.StateRoot.String(),
+		ReceiptsRoot:  block.Header.ReceiptsRoot.String(),
+		Proposer:      block.Header.Proposer.String(),
 		Timestamp:     block.Header.Timestamp,
-		Validator:     block.Validatar.Address().String(),
-		Signature:     block.Signature.String(),
+		Extra:         hex.EncodeToString(block.Header.Extra),
+		Validator:     validator,
+		Signature:     signature,
 		TxResponse:    txResponse,
 	}
 }
+func intoJSONTx(tx *core.Transaction) Transaction {
+	res := Transaction{
+		Hash:    tx.Hash(core.TxHasher{}).String(),
+		Type:    tx.Type.String(),
+		ChainID: tx.ChainID,
+		Nonce:   tx.Nonce,
+		From:    tx.From.Address().String(),
+		Value:   tx.Value,
+		Fee:     tx.Fee,
+		Data:    hex.EncodeToString(tx.Data),
+
+		ValidUntilHeight: tx.ValidUntilHeight,
+		ValidUntilTime:   tx.ValidUntilTime,
+	}
+	if tx.Type == core.TxTypeTransfer || tx.Type == core.TxTypeCall {
+		res.To = tx.To.String()
+	}
+	if tx.Signature != nil {
+		res.Signature = tx.Signature.String()
+	}
+	return res
+}
+func intoJSONReceipt(r *core.Receipt) Receipt {
+	keys := make([]string, len(r.WrittenKeys))
+	for i, k := range r.WrittenKeys {
+		keys[i] = hex.EncodeToString(k)
+	}
+	return Receipt{
+		TxHash:      r.TxHash.String(),
+		BlockHash:   r.BlockHash.String(),
+		BlockHeight: r.BlockHeight,
+		TxIndex:     r.TxIndex,
+		Status:      r.Status.String(),
+		Error:       r.Error,
+		Result:      hex.EncodeToString(r.Result),
+		WrittenKeys: keys,
+		Cost:        r.Cost,
+		Fee:         r.Fee,
+	}
+}
+func intoJSONTxProof(p *core.TxProof, h *core.Header) TxProof {
+	hashes := make([]string, len(p.Proof.Hashes))
+	for i, hash := range p.Proof.Hashes {
+		hashes[i] = hash.String()
+	}
+	return TxProof{
+		TxHash:    p.Tx.Hash(core.TxHasher{}).String(),
+		BlockHash: p.BlockHash.String(),
+		DataHash:  h.DataHash.String(),
+		Index:     p.Proof.Index,
+		Count:     p.Proof.Count,
+		Hashes:    hashes,
+	}
+}
+func intoJSONStateProof(p *core.StateProof, h *core.Header) StateProof {
+	siblings := make([]string, len(p.Siblings))
+	for i, hash := range p.Siblings {
+		siblings[i] = hash.String()
+	}
+	res := StateProof{
+		Key:       hex.EncodeToString(p.Key),
+		Exists:    p.Exists,
+		Value:     hex.EncodeToString(p.Value),
+		BlockHash: core.BlockHasher{}.Hash(h).String(),
+		Height:    h.Height,
+		StateRoot: h.StateRoot.String(),
+		Siblings:  siblings,
+	}
+	if p.Other != nil {
+		res.OtherPath = p.Other.Path.String()
+		res.OtherValueHash = p.Other.ValueHash.String()
+	}
+	return res
+}
+func intoJSONKeyChanges(changes []core.KeyChange) []KeyChange {
+	res := make([]KeyChange, len(changes))
+	for i, c := range changes {
+		res[i] = KeyChange{
+			Key:  hex.EncodeToString(c.Key),
+			Kind: c.Kind.String(),
+			Old:  hex.EncodeToString(c.Old),
+			New:  hex.EncodeToString(c.New),
+		}
+	}
+	return res
+}
+func intoJSONStateDiff(d *core.StateDiff) StateDiff {
+	txs := make([]TxDiff, len(d.Txs))
+	for i, tx := range d.Txs {
+		txs[i] = TxDiff{TxHash: tx.TxHash.String(), Changes: intoJSONKeyChanges(tx.Changes)}
+	}
+	return StateDiff{
+		BlockHash: d.BlockHash.String(),
+		Height:    d.Height,
+		Changes:   intoJSONKeyChanges(d.Changes),
+		Txs:       txs,
+	}
+}
+func intoJSONEvent(e core.Event) Event {
+	switch t := e.(type) {
+	case core.NewHeadEvent:
+		block := intoJSONBlock(t.Block)
+		return Event{Type: "newHead", Block: &block}
+	case core.BlockAddedEvent:
+		block := intoJSONBlock(t.Block)
+		return Event{Type: "blockAdded", Block: &block}
+	case core.TxIncludedEvent:
+		event := Event{Type: "txIncluded", TxHash: t.Tx.Hash(core.TxHasher{}).String()}
+		if t.Receipt != nil {
+			receipt := intoJSONReceipt(t.Receipt)
+			event.Receipt = &receipt
+		}
+		return event
+	case core.ReorgEvent:
+		return Event{Type: "reorg", Reorg: intoJSONReorg(t.Reorg)}
+	}
+	return Event{Type: "unknown"}
+}
+func intoJSONReorg(r *core.Reorg) *Reorg {
+	reorg := &Reorg{
+		Ancestor:  core.BlockHasher{}.Hash(r.Ancestor).String(),
+		OldBranch: make([]string, len(r.OldBranch)),
+		NewBranch: make([]string, len(r.NewBranch)),
+		Dropped:   make([]string, len(r.Dropped)),
+	}
+	for i, b := range r.OldBranch {
+		reorg.OldBranch[i] = b.Hash(core.BlockHasher{}).String()
+	}
+	for i, b := range r.NewBranch {
+		reorg.NewBranch[i] = b.Hash(core.BlockHasher{}).String()
+	}
+	for i, tx := range r.Dropped {
+		reorg.Dropped[i] = tx.Hash(core.TxHasher{}).String()
+	}
+	return reorg
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"myblockchain/core"
+	"myblockchain/networks"
+	"myblockchain/types"
+	"os"
+
+	"github.com/go-kit/log"
+)
+
+// progressInterval is the number of blocks between two progress lines.
+const progressInterval = 1000
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "export":
+		return exportCommand(args)
+	case "import":
+		return importCommand(args)
+	case "light":
+		return lightCommand(args)
+	case "diff":
+		return diffCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q, available commands: export, import, light, diff", name)
+	}
+}
+
+func loadGenesis(genesisFile string) (*core.Genesis, error) {
+	if len(genesisFile) == 0 {
+		return core.DefaultGenesis(), nil
+	}
+	return core.LoadGenesis(genesisFile)
+}
+
+func openChain(logger log.Logger, dataDir, genesisFile string) (*core.BlockChain, error) {
+	if len(dataDir) == 0 {
+		return nil, fmt.Errorf("-datadir is required")
+	}
+	g, err := loadGenesis(genesisFile)
+	if err != nil {
+		return nil, err
+	}
+	store, err := core.NewFileStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	bc, err := core.NewBlockChainFromGenesis(core.BlockChainOptions{Logger: logger, Store: store}, g)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+func exportCommand(args []string) error {
+	var (
+		fs          = flag.NewFlagSet("export", flag.ExitOnError)
+		dataDir     = fs.String("datadir", "", "directory of the chain to export")
+		genesisFile = fs.String("genesis", "", "genesis file of the chain")
+		from        = fs.Uint("from", 0, "first block to export")
+		to          = fs.Int("to", -1, "last block to export, defaults to the tip")
+		out         = fs.String("out", "chain.export", "file to export to")
+	)
+	fs.Parse(args)
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bc, err := openChain(logger, *dataDir, *genesisFile)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+	last := bc.Height()
+	if *to >= 0 {
+		last = uint32(*to)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = core.ExportChain(bc, f, uint32(*from), last, func(height uint32) {
+		if height%progressInterval == 0 || height == last {
+			logger.Log("msg", "exporting blocks", "height", height, "to", last)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	logger.Log("msg", "export done", "file", *out, "from", *from, "to", last)
+	return f.Sync()
+}
+
+func importCommand(args []string) error {
+	var (
+		fs          = flag.NewFlagSet("import", flag.ExitOnError)
+		dataDir     = fs.String("datadir", "", "directory of the chain to import into")
+		genesisFile = fs.String("genesis", "", "genesis file of the chain")
+		in          = fs.String("in", "chain.export", "file to import from")
+	)
+	fs.Parse(args)
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	bc, err := openChain(log.NewNopLogger(), *dataDir, *genesisFile)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := core.ImportChain(bc, f, func(p core.ImportProgress) {
+		if p.Height%progressInterval == 0 || p.Height == p.To {
+			logger.Log("msg", "importing blocks", "height", p.Height, "to", p.To, "imported", p.Imported, "skipped", p.Skipped)
+		}
+	})
+	if err != nil {
+		logger.Log("msg", "import stopped, run the import again to resume", "imported", p.Imported, "skipped", p.Skipped)
+		return err
+	}
+	logger.Log("msg", "import done", "imported", p.Imported, "skipped", p.Skipped, "height", bc.Height())
+	return nil
+}
+
+// diffCommand prints what the blocks of a range changed in the state, per
+// transaction and as a whole.
+func diffCommand(args []string) error {
+	var (
+		fs          = flag.NewFlagSet("diff", flag.ExitOnError)
+		dataDir     = fs.String("datadir", "", "directory of the chain")
+		genesisFile = fs.String("genesis", "", "genesis file of the chain")
+		from        = fs.Uint("from", 0, "first block to dump")
+		to          = fs.Int("to", -1, "last block to dump, defaults to the tip")
+	)
+	fs.Parse(args)
+
+	bc, err := openChain(log.NewNopLogger(), *dataDir, *genesisFile)
+	if err != nil {
+		return err
+	}
+	defer bc.Close()
+	last := bc.Height()
+	if *to >= 0 {
+		last = uint32(*to)
+	}
+	for height := uint32(*from); height <= last; height++ {
+		diff, err := bc.GetStateDiff(height)
+		if err != nil {
+			return err
+		}
+		dumpStateDiff(os.Stdout, diff)
+	}
+	return nil
+}
+
+func dumpStateDiff(w io.Writer, diff *core.StateDiff) {
+	fmt.Fprintf(w, "block %d %s\n", diff.Height, diff.BlockHash)
+	for _, tx := range diff.Txs {
+		fmt.Fprintf(w, "  tx %s\n", tx.TxHash)
+		dumpKeyChanges(w, "    ", tx.Changes)
+	}
+	fmt.Fprintf(w, "  block\n")
+	dumpKeyChanges(w, "    ", diff.Changes)
+}
+
+func dumpKeyChanges(w io.Writer, indent string, changes []core.KeyChange) {
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s%-8s %q %x -> %x\n", indent, c.Kind, c.Key, c.Old, c.New)
+	}
+}
+
+// lightCommand syncs the headers of a full node and optionally fetches a
+// transaction with its proof of inclusion.
+func lightCommand(args []string) error {
+	var (
+		fs          = flag.NewFlagSet("light", flag.ExitOnError)
+		peer        = fs.String("peer", ":3000", "full node to sync from")
+		genesisFile = fs.String("genesis", "", "genesis file of the chain")
+		txHash      = fs.String("tx", "", "hash of a transaction to fetch and verify")
+	)
+	fs.Parse(args)
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	g, err := loadGenesis(*genesisFile)
+	if err != nil {
+		return err
+	}
+	lc, err := networks.NewLightClient(networks.LightClientOptions{
+		Logger:  logger,
+		Genesis: g,
+		Peer:    *peer,
+	})
+	if err != nil {
+		return err
+	}
+	defer lc.Close()
+	height, err := lc.Sync()
+	if err != nil {
+		return err
+	}
+	logger.Log("msg", "headers synced", "height", height)
+	if len(*txHash) == 0 {
+		return nil
+	}
+	b, err := hex.DecodeString(*txHash)
+	if err != nil || len(b) != 32 {
+		return fmt.Errorf("invalid tx hash %q", *txHash)
+	}
+	tx, err := lc.GetTransaction(types.HashFromBytes(b))
+	if err != nil {
+		return err
+	}
+	logger.Log("msg", "transaction verified", "hash", *txHash, "data", hex.EncodeToString(tx.Data), "from", tx.From.Address())
+	return nil
+}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"myblockchain/types"
+)
+
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrBadNonce          = errors.New("bad nonce")
+)
+
+// Account is what the state holds for every address.
+type Account struct {
+	Balance uint64
+	// Nonce is the nonce the next transaction of the account must carry.
+	Nonce uint64
+}
+
+const accountSize = 16
+
+func (a *Account) Bytes() []byte {
+	buf := binary.BigEndian.AppendUint64(nil, a.Balance)
+	return binary.BigEndian.AppendUint64(buf, a.Nonce)
+}
+
+func accountKey(addr types.Address) []byte {
+	return append([]byte("account/"), addr[:]...)
+}
+
+// GetAccount returns the account of the address, an empty one if the
+// address never received anything.
+func (s *State) GetAccount(addr types.Address) (*Account, error) {
+	b, err := s.Get(accountKey(addr))
+	if err != nil {
+		return &Account{}, nil
+	}
+	if len(b) != accountSize {
+		return nil, fmt.Errorf("account %s has invalid encoding", addr)
+	}
+	return &Account{
+		Balance: binary.BigEndian.Uint64(b),
+		Nonce:   binary.BigEndian.Uint64(b[8:]),
+	}, nil
+}
+
+func (s *State) PutAccount(addr types.Address, a *Account) error {
+	return s.Put(accountKey(addr), a.Bytes())
+}
+
+// transfer moves value from one account to another.
+func (s *State) transfer(from, to types.Address, value uint64) error {
+	if value == 0 {
+		return nil
+	}
+	sender, err := s.GetAccount(from)
+	if err != nil {
+		return err
+	}
+	if sender.Balance < value {
+		return fmt.Errorf("%w: %s has %d, needs %d", ErrInsufficientFunds, from, sender.Balance, value)
+	}
+	sender.Balance -= value
+	if err := s.PutAccount(from, sender); err != nil {
+		return err
+	}
+	recipient, err := s.GetAccount(to)
+	if err != nil {
+		return err
+	}
+	if recipient.Balance+value < recipient.Balance {
+		return fmt.Errorf("balance of %s overflows", to)
+	}
+	recipient.Balance += value
+	return s.PutAccount(to, recipient)
+}
+
+// credit adds the amount to the balance of the address.
+func (s *State) credit(addr types.Address, amount uint64) error {
+	if amount == 0 {
+		return nil
+	}
+	account, err := s.GetAccount(addr)
+	if err != nil {
+		return err
+	}
+	if account.Balance+amount < account.Balance {
+		return fmt.Errorf("balance of %s overflows", addr)
+	}
+	account.Balance += amount
+	return s.PutAccount(addr, account)
+}
+
+// chargeTx checks that the transaction is the next one of its sender and
+// that the sender can pay for its value and fee, advances the nonce of the
+// sender and pays the fee to the proposer. The fee is paid even if the
+// transaction fails later on. Nothing is written if the transaction cannot
+// be included.
+func (s *State) chargeTx(tx *Transaction, proposer types.Address) error {
+	from := tx.From.Address()
+	sender, err := s.GetAccount(from)
+	if err != nil {
+		return err
+	}
+	if tx.Nonce != sender.Nonce {
+		return fmt.Errorf("%w: %s has nonce %d, tx has %d", ErrBadNonce, from, sender.Nonce, tx.Nonce)
+	}
+	if tx.Value+tx.Fee < tx.Value || sender.Balance < tx.Value+tx.Fee {
+		return fmt.Errorf("%w: %s has %d, tx needs %d and a fee of %d", ErrInsufficientFunds, from, sender.Balance, tx.Value, tx.Fee)
+	}
+	proposerAccount, err := s.GetAccount(proposer)
+	if err != nil {
+		return err
+	}
+	if from != proposer && proposerAccount.Balance+tx.Fee < proposerAccount.Balance {
+		return fmt.Errorf("balance of %s overflows", proposer)
+	}
+	sender.Nonce++
+	sender.Balance -= tx.Fee
+	if err := s.PutAccount(from, sender); err != nil {
+		return err
+	}
+	return s.credit(proposer, tx.Fee)
+}
+
+// GetAccount returns the account of the address at the tip of the chain.
+func (bc *BlockChain) GetAccount(addr types.Address) (*Account, error) {
+	return bc.StateView().GetAccount(addr)
+}
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFundedChain(t *testing.T, funded crypto.PrivateKey, balance uint64) *BlockChain {
+	g := DefaultGenesis()
+	g.Alloc = map[string]uint64{funded.PublicKey().Address().String(): balance}
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{}, g)
+	assert.Nil(t, err)
+	return bc
+}
+
+func transferTx(t *testing.T, bc *BlockChain, from, to crypto.PrivateKey, nonce, value uint64) *Transaction {
+	tx := &Transaction{
+		Type:    TxTypeTransfer,
+		ChainID: bc.ChainID(),
+		Nonce:   nonce,
+		To:      to.PublicKey().Address(),
+		Value:   value,
+	}
+	assert.Nil(t, tx.Sign(from))
+	return tx
+}
+
+func assertAccount(t *testing.T, bc *BlockChain, key crypto.PrivateKey, balance, nonce uint64) {
+	account, err := bc.GetAccount(key.PublicKey().Address())
+	assert.Nil(t, err)
+	assert.Equal(t, &Account{Balance: balance, Nonce: nonce}, account)
+}
+
+func TestTransfer(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	assertAccount(t, bc, alice, 100, 0)
+	assertAccount(t, bc, bob, 0, 0)
+
+	tx := transferTx(t, bc, alice, bob, 0, 40)
+	mustAdd(t, bc, proposeBlock(t, bc, tx))
+	assertAccount(t, bc, alice, 60, 1)
+	assertAccount(t, bc, bob, 40, 0)
+
+	// a replay and an overspend are left out of the next block
+	b := mustAdd(t, bc, proposeBlock(t, bc, tx, transferTx(t, bc, alice, bob, 1, 61)))
+	assert.Len(t, b.Transactions, 0)
+	assertAccount(t, bc, alice, 60, 1)
+}
+
+func TestBlockWithUnpayableTxIsRejected(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+
+	blockWith := func(tx *Transaction) *Block {
+		tip, err := bc.GetHeader(bc.Height())
+		assert.Nil(t, err)
+		b, err := NewBlockFromHeader(tip, []*Transaction{tx}, HeaderFields{Proposer: alice.PublicKey().Address()})
+		assert.Nil(t, err)
+		assert.Nil(t, b.Sign(alice))
+		return b
+	}
+	assert.ErrorIs(t, bc.AddBlock(blockWith(transferTx(t, bc, alice, bob, 0, 101))), ErrInsufficientFunds)
+	assert.ErrorIs(t, bc.AddBlock(blockWith(transferTx(t, bc, alice, bob, 1, 10))), ErrBadNonce)
+	assert.Equal(t, uint32(0), bc.Height())
+	assertAccount(t, bc, alice, 100, 0)
+}
+
+// scriptSafeKey returns a key whose address holds no instruction bytes.
+// storeCode runs the bytes of a key as instructions, an account key with
+// any of them in its address would fail for another reason.
+func scriptSafeKey() crypto.PrivateKey {
+next:
+	for {
+		key := crypto.GeneratePrivateKey()
+		for _, b := range key.PublicKey().Address() {
+			if b >= byte(InstrPushInt) && b <= byte(InstrStore) {
+				continue next
+			}
+		}
+		return key
+	}
+}
+
+func TestScriptsCannotWriteAccounts(t *testing.T) {
+	alice := scriptSafeKey()
+	bc := newFundedChain(t, alice, 100)
+
+	key := string(accountKey(alice.PublicKey().Address()))
+	b := mustAdd(t, bc, blockWithCode(t, bc, storeCode(key, 0xff)))
+	receipt, err := bc.GetReceipt(b.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, receipt.Status)
+	assertAccount(t, bc, alice, 100, 0)
+}
+
+func TestGenesisAlloc(t *testing.T) {
+	g := DefaultGenesis()
+	g.Alloc = map[string]uint64{"abcd": 1}
+	assert.NotNil(t, g.Validate())
+
+	alice := crypto.GeneratePrivateKey()
+	g.Alloc = map[string]uint64{alice.PublicKey().Address().String(): 1}
+	a, err := g.ToBlock()
+	assert.Nil(t, err)
+	g.Alloc[alice.PublicKey().Address().String()] = 2
+	b, err := g.ToBlock()
+	assert.Nil(t, err)
+	assert.NotEqual(t, a.Hash(BlockHasher{}), b.Hash(BlockHasher{}))
+}
+
+func TestFeesAndBlockReward(t *testing.T) {
+	alice, bob, proposer := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	g := DefaultGenesis()
+	g.Alloc = map[string]uint64{alice.PublicKey().Address().String(): 100}
+	g.Consensus.BlockReward = 5
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{}, g)
+	assert.Nil(t, err)
+
+	transfer := &Transaction{Type: TxTypeTransfer, ChainID: bc.ChainID(), To: bob.PublicKey().Address(), Value: 10, Fee: 3}
+	assert.Nil(t, transfer.Sign(alice))
+	// the call fails, its fee is paid anyway
+	call := &Transaction{Type: TxTypeCall, ChainID: bc.ChainID(), Nonce: 1, To: bob.PublicKey().Address(), Fee: 2}
+	assert.Nil(t, call.Sign(alice))
+	// nothing left for the fee
+	broke := &Transaction{Type: TxTypeTransfer, ChainID: bc.ChainID(), Nonce: 2, To: bob.PublicKey().Address(), Value: 85, Fee: 1}
+	assert.Nil(t, broke.Sign(alice))
+
+	b, err := bc.ProposeBlock(proposer, []*Transaction{transfer, call, broke})
+	assert.Nil(t, err)
+	assert.Len(t, b.Transactions, 2)
+	mustAdd(t, bc, b)
+
+	assertAccount(t, bc, alice, 85, 2)
+	assertAccount(t, bc, bob, 10, 0)
+	assertAccount(t, bc, proposer, 3+2+5, 0)
+	for _, tx := range []*Transaction{transfer, call} {
+		receipt, err := bc.GetReceipt(tx.Hash(TxHasher{}))
+		assert.Nil(t, err)
+		assert.Equal(t, tx.Fee, receipt.Fee)
+	}
+	receipt, err := bc.GetReceipt(call.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, receipt.Status)
+
+	// the reward is paid for empty blocks too
+	mustAdd(t, bc, proposeBlock(t, bc))
+	assertAccount(t, bc, proposer, 3+2+5, 0)
+	b, err = bc.ProposeBlock(proposer, nil)
+	assert.Nil(t, err)
+	mustAdd(t, bc, b)
+	assertAccount(t, bc, proposer, 3+2+5+5, 0)
+}
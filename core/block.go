@@ -1,9 +1,6 @@
 package core
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"myblockchain/crypto"
 	"myblockchain/types"
@@ -12,17 +9,24 @@ import (
 
 type Header struct {
 	Version       uint32
+	ChainID       uint32
 	DataHash      types.Hash
 	PrevBlockHash types.Hash
-	Timestamp     uint64
-	Height        uint32
+	// StateRoot and ReceiptsRoot commit to the state and the receipts after
+	// executing the block.
+	StateRoot    types.Hash
+	ReceiptsRoot types.Hash
+	Proposer     types.Address
+	Timestamp    uint64
+	Height       uint32
+	// Extra is free for the proposer to fill, up to MaxExtraSize bytes.
+	Extra []byte
 }
 
+// Bytes returns the canonical encoding of the header, which is what block
+// hashes and signatures are computed over.
 func (h *Header) Bytes() []byte {
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(h)
-	return buf.Bytes()
+	return encodeHeader(h)
 }
 
 type Block struct {
@@ -40,20 +44,50 @@ func NewBlock(h *Header, txs []*Transaction) *Block {
 	}
 }
 
-func NewBlockFromHeader(prev *Header, txx []*Transaction) (*Block, error) {
+// HeaderFields are the fields of a new header that do not follow from the
+// previous one.
+type HeaderFields struct {
+	Proposer types.Address
+	// Timestamp defaults to the current time, after the one of the
+	// previous header.
+	Timestamp    uint64
+	StateRoot    types.Hash
+	ReceiptsRoot types.Hash
+	Extra        []byte
+}
+
+// NewBlockFromHeader returns the block with the given transactions on top
+// of prev. Its header is complete before the block is hashed.
+func NewBlockFromHeader(prev *Header, txx []*Transaction, fields HeaderFields) (*Block, error) {
 	dataHash, err := CaculateDataHash(txx)
 	if err != nil {
 		return nil, err
 	}
+	if fields.Timestamp == 0 {
+		fields.Timestamp = nextTimestamp(time.Now(), prev)
+	}
 	header := &Header{
 		Version:       1,
+		ChainID:       prev.ChainID,
 		Height:        prev.Height + 1,
 		DataHash:      dataHash,
 		PrevBlockHash: BlockHasher{}.Hash(prev),
-		Timestamp:     uint64(time.Now().UnixNano()),
+		StateRoot:     fields.StateRoot,
+		ReceiptsRoot:  fields.ReceiptsRoot,
+		Proposer:      fields.Proposer,
+		Timestamp:     fields.Timestamp,
+		Extra:         fields.Extra,
 	}
 	return NewBlock(header, txx), nil
+}
 
+// nextTimestamp returns the timestamp of a block on top of prev made at the
+// given time, after the one of prev even if the clock is behind.
+func nextTimestamp(now time.Time, prev *Header) uint64 {
+	if t := uint64(now.UnixNano()); t > prev.Timestamp {
+		return t
+	}
+	return prev.Timestamp + 1
 }
 
 func (b *Block) AddTransaction(tx *Transaction) {
@@ -77,7 +111,18 @@ func (b *Block) Verify() error {
 	if !b.Signature.Verify(b.Header.Bytes(), b.Validatar) {
 		return fmt.Errorf("Block signature is invalid")
 	}
+	return b.verifyData()
+}
+
+// verifyData checks the transactions of the block against its header.
+func (b *Block) verifyData() error {
 	for _, tx := range b.Transactions {
+		if tx.ChainID != b.ChainID {
+			return fmt.Errorf("%w: block (%d) of chain %d has tx for chain %d", ErrWrongChain, b.Height, b.ChainID, tx.ChainID)
+		}
+		if tx.Expired(b.Height, b.Timestamp) {
+			return fmt.Errorf("%w: block (%d) has tx (%s)", ErrTxExpired, b.Height, tx.Hash(TxHasher{}))
+		}
 		if err := tx.Verify(); err != nil {
 			return err
 		}
@@ -109,15 +154,9 @@ func (b *Block) Hash(hasher Hasher[*Header]) types.Hash {
 	return b.hash
 }
 
+// CaculateDataHash returns the Merkle root of the hashes of the given
+// transactions, which lets a single transaction be proven to be part of a
+// block without the rest of it.
 func CaculateDataHash(txs []*Transaction) (hash types.Hash, err error) {
-	buf := &bytes.Buffer{}
-
-	for _, tx := range txs {
-		if err := tx.Encode(NewGobTxEncoder(buf)); err != nil {
-			return types.Hash{}, err
-		}
-	}
-	hash = sha256.Sum256(buf.Bytes())
-	return hash, nil
-
+	return MerkleRoot(txLeaves(txs)), nil
 }
@@ -64,3 +64,25 @@ func TestDecodeEncodeBlock(t *testing.T) {
 	assert.Nil(t, decodedBlock.Decode(NewGobBlockDecoder(buf)))
 	assert.Equal(t, b, decodedBlock)
 }
+
+func TestNewBlockFromHeaderFillsHeader(t *testing.T) {
+	prev := randBlock(t, 1, types.Hash{0x1}).Header
+	fields := HeaderFields{
+		Proposer:     crypto.GeneratePrivateKey().PublicKey().Address(),
+		Timestamp:    prev.Timestamp + 1,
+		StateRoot:    types.Hash{0x2},
+		ReceiptsRoot: types.Hash{0x3},
+		Extra:        []byte("extra"),
+	}
+	b, err := NewBlockFromHeader(prev, nil, fields)
+	assert.Nil(t, err)
+	assert.Equal(t, fields.Proposer, b.Proposer)
+	assert.Equal(t, fields.StateRoot, b.StateRoot)
+	assert.Equal(t, fields.ReceiptsRoot, b.ReceiptsRoot)
+	assert.Equal(t, fields.Extra, b.Extra)
+	assert.Equal(t, BlockHasher{}.Hash(prev), b.PrevBlockHash)
+
+	b, err = NewBlockFromHeader(prev, nil, HeaderFields{})
+	assert.Nil(t, err)
+	assert.Greater(t, b.Timestamp, prev.Timestamp)
+}
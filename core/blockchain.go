@@ -4,85 +4,404 @@ import (
 	"fmt"
 	"myblockchain/types"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 )
 
+const (
+	defaultBlockCacheSize     = 256
+	defaultCheckpointInterval = 256
+	// pastStateCacheSize is how many states read back from the store an
+	// archive node keeps in memory.
+	pastStateCacheSize = 16
+)
+
 type BlockChain struct {
-	Logger        log.Logger
-	store         Storage
-	lock          sync.RWMutex
-	headers       []*Header
-	blocks        []*Block
-	txStore       map[types.Hash]*Transaction
-	blockStore    map[types.Hash]*Block
-	validator     Validator
+	Logger log.Logger
+	store  Storage
+	lock   sync.RWMutex
+	height uint32
+	// recently used blocks by height, everything else is read from the store.
+	cache *types.LRU[uint32, *Block]
+	// rewinds counts the rewinds of the chain, a block read from the store
+	// before one may be orphaned and must not go into the cache.
+	rewinds uint64
+	// side branches, by hash and by the hash of their parent
+	sideBlocks   map[types.Hash]*Block
+	forks        map[types.Hash][]*Block
+	forkChoice   ForkChoice
+	maxForkDepth uint32
+	// the local clock, blocks too far ahead of it are rejected
+	maxFutureTime time.Duration
+	now           func() time.Time
+	events        *eventFeed
+	addLock       sync.Mutex
+	genesis       *Genesis
+	chainID       uint32
+	// validators allowed to sign blocks, empty means everyone is
+	validators map[types.Address]bool
+	validator  Validator
+	// contractState is only touched while a block is added, readers get
+	// the view of it published after the last block
 	contractState *State
+	head          *StateView
+	// per height, the view of the state after the block, kept for the last
+	// stateHistory blocks. The views share everything but the paths of the
+	// tree their blocks wrote. An archive node reads older states back from
+	// the checkpoints and state diffs in the store.
+	versions           map[uint32]*StateView
+	stateHistory       uint32
+	archive            bool
+	checkpointInterval uint32
+	// recently read states of an archive node that are no longer in
+	// versions, and the checkpoints they were read from
+	pastStates  *types.LRU[uint32, *StateView]
+	checkpoints *types.LRU[uint32, *State]
+}
+
+type BlockChainOptions struct {
+	Logger log.Logger
+	// Store holds the blocks of the chain. If the store already contains
+	// blocks the chain is rebuilt from it, defaults to a MemoryStore.
+	Store Storage
+	// CacheSize is the number of blocks kept in memory.
+	CacheSize int
+	// ForkChoice picks the canonical branch, defaults to the longest chain
+	// with ties broken by the lowest block hash.
+	ForkChoice ForkChoice
+	// MaxForkDepth is how far below the tip side branches are kept around.
+	MaxForkDepth uint32
+	// MaxFutureTime is how far ahead of the local clock the timestamp of a
+	// block may be, defaults to 15 seconds.
+	MaxFutureTime time.Duration
+	// Now returns the local time, defaults to time.Now.
+	Now func() time.Time
+	// StateHistory is for how many blocks below the tip the state is kept
+	// in memory, it is never less than MaxForkDepth. Older states can only
+	// be read on an Archive node, which reads them back from the store.
+	StateHistory uint32
+	Archive      bool
+	// CheckpointInterval is every how many blocks the whole state is
+	// stored, defaults to 256. Reading an older state applies at most
+	// CheckpointInterval-1 state diffs to the checkpoint below it, and a
+	// reopened chain executes at most StateHistory+CheckpointInterval
+	// blocks. Only an archive node keeps every checkpoint, others keep the
+	// last one.
+	CheckpointInterval uint32
 }
 
 func NewBlockChain(l log.Logger, genesis *Block) (*BlockChain, error) {
+	return NewBlockChainWithOptions(BlockChainOptions{Logger: l}, genesis)
+}
+
+// NewBlockChainFromGenesis creates the chain described by the given genesis,
+// seeding its initial state and validator set.
+func NewBlockChainFromGenesis(opts BlockChainOptions, g *Genesis) (*BlockChain, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	block, err := g.ToBlock()
+	if err != nil {
+		return nil, err
+	}
+	validators, err := g.validatorAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return newBlockChain(opts, block, func(bc *BlockChain) error {
+		bc.genesis = g
+		for _, addr := range validators {
+			bc.validators[addr] = true
+		}
+		return g.Commit(bc.contractState)
+	})
+}
+
+func NewBlockChainWithOptions(opts BlockChainOptions, genesis *Block) (*BlockChain, error) {
+	return newBlockChain(opts, genesis, nil)
+}
+
+func newBlockChain(opts BlockChainOptions, genesis *Block, init func(*BlockChain) error) (*BlockChain, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore()
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = defaultBlockCacheSize
+	}
+	if opts.ForkChoice == nil {
+		opts.ForkChoice = LongestChain{PreferLowerHash: true}
+	}
+	if opts.MaxForkDepth == 0 {
+		opts.MaxForkDepth = defaultMaxForkDepth
+	}
+	if opts.MaxFutureTime == 0 {
+		opts.MaxFutureTime = defaultMaxFutureTime
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.StateHistory < opts.MaxForkDepth {
+		opts.StateHistory = opts.MaxForkDepth
+	}
+	if opts.CheckpointInterval == 0 {
+		opts.CheckpointInterval = defaultCheckpointInterval
+	}
 	bc := &BlockChain{
-		store:         NewMemoryStore(),
-		headers:       []*Header{},
-		Logger:        l,
-		blockStore:    make(map[types.Hash]*Block),
-		txStore:       make(map[types.Hash]*Transaction),
+		store:         opts.Store,
+		Logger:        opts.Logger,
+		cache:         types.NewLRU[uint32, *Block](opts.CacheSize),
+		sideBlocks:    make(map[types.Hash]*Block),
+		forks:         make(map[types.Hash][]*Block),
+		forkChoice:    opts.ForkChoice,
+		maxForkDepth:  opts.MaxForkDepth,
+		maxFutureTime: opts.MaxFutureTime,
+		now:           opts.Now,
+		chainID:       genesis.ChainID,
+		events:        newEventFeed(),
+		validators:    make(map[types.Address]bool),
 		contractState: NewState(),
+		versions:      make(map[uint32]*StateView),
+		stateHistory:  opts.StateHistory,
+		archive:       opts.Archive,
+
+		checkpointInterval: opts.CheckpointInterval,
+		pastStates:         types.NewLRU[uint32, *StateView](pastStateCacheSize),
+		checkpoints:        types.NewLRU[uint32, *State](pastStateCacheSize),
 	}
 	bc.validator = NewBlockValidator(bc)
-	err := bc.addBlockWithoutValidation(genesis)
-	return bc, err
+	if init != nil {
+		if err := init(bc); err != nil {
+			return nil, err
+		}
+	}
+	bc.head = &StateView{State: bc.contractState.View(), Header: genesis.Header}
+	bc.versions[genesis.Height] = bc.head
+	if bc.store.Len() > 0 {
+		return bc, bc.loadFromStore(genesis)
+	}
+	if err := bc.addBlockWithoutValidation(genesis); err != nil {
+		return nil, err
+	}
+	if err := bc.store.PutReceipts(0, nil); err != nil {
+		return nil, err
+	}
+	if err := bc.store.PutStateDiff(0, genesisDiff(genesis, bc.contractState)); err != nil {
+		return nil, err
+	}
+	return bc, bc.store.PutStateCheckpoint(0, bc.contractState.entries())
+}
+
+// linkCheckingStore is a store that checked, when it was opened, that every
+// block it holds claims its height and links to its parent.
+type linkCheckingStore interface {
+	checksLinks()
+}
+
+// loadFromStore reopens a chain that is already persisted, making sure the
+// store belongs to the given genesis and that every stored block links to
+// its parent. Only the hash of the previous block is kept while the store
+// is walked, stores that check the links themselves are not walked again.
+func (bc *BlockChain) loadFromStore(genesis *Block) error {
+	height := bc.store.Len() - 1
+	if _, ok := bc.store.(linkCheckingStore); !ok {
+		if err := bc.checkLinks(height); err != nil {
+			return err
+		}
+	}
+	stored, err := bc.store.Get(0)
+	if err != nil {
+		return err
+	}
+	if stored.Hash(BlockHasher{}) != genesis.Hash(BlockHasher{}) {
+		return fmt.Errorf("stored genesis (%s) does not match genesis (%s)", stored.Hash(BlockHasher{}), genesis.Hash(BlockHasher{}))
+	}
+	tip, err := bc.store.Get(height)
+	if err != nil {
+		return err
+	}
+	if err := bc.replayState(height); err != nil {
+		return err
+	}
+	bc.indexBlock(tip)
+	bc.Logger.Log("msg", "loaded blockchain from store", "height", bc.Height())
+	return nil
+}
+
+// checkLinks walks the store up to the given height and checks that every
+// block claims its height and links to its parent.
+func (bc *BlockChain) checkLinks(height uint32) error {
+	var (
+		next = uint32(0)
+		prev types.Hash
+	)
+	return bc.store.Range(0, height, func(b *Block) error {
+		if b.Height != next {
+			return fmt.Errorf("%w: block at height (%d) claims height (%d)", ErrStoreCorrupted, next, b.Height)
+		}
+		if next > 0 && b.PrevBlockHash != prev {
+			return fmt.Errorf("%w: block (%d) does not link to its parent", ErrStoreCorrupted, next)
+		}
+		prev = b.Hash(BlockHasher{})
+		next++
+		return nil
+	})
+}
+
+// Genesis returns the genesis the chain was created from, nil if the chain
+// was created from a bare genesis block.
+func (bc *BlockChain) Genesis() *Genesis {
+	return bc.genesis
+}
+
+// ChainID returns the id of the chain, transactions must carry it.
+func (bc *BlockChain) ChainID() uint32 {
+	return bc.chainID
+}
+
+// consensus returns the consensus parameters of the chain, all zero for a
+// chain created from a bare genesis block.
+func (bc *BlockChain) consensus() ConsensusParams {
+	if bc.genesis == nil {
+		return ConsensusParams{}
+	}
+	return bc.genesis.Consensus
+}
+
+// IsValidator reports whether the given address may sign blocks.
+func (bc *BlockChain) IsValidator(addr types.Address) bool {
+	return len(bc.validators) == 0 || bc.validators[addr]
+}
+
+// Close ends all subscriptions and releases the underlying store.
+func (bc *BlockChain) Close() error {
+	bc.events.close()
+	return bc.store.Close()
 }
 
 func (b *BlockChain) SetValidator(v Validator) {
 	b.validator = v
 }
 
+// AddBlock validates the block and either appends it to the canonical chain
+// or keeps it on a side branch, switching branches when the fork choice
+// prefers the one the block belongs to.
 func (bc *BlockChain) AddBlock(b *Block) error {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
 	//validate block
 	if err := bc.validator.ValidateBlock(b); err != nil {
 		return err
 	}
 
-	// for _, tx := range b.Transactions {
-	// 	bc.Logger.Log("msg", "executing code", "len", len(tx.Data), "hash", tx.Hash(&TxHasher{}))
-	// 	vm := NewVM(tx.Data, bc.contractState)
-	// 	vm.Run()
-	// 	bc.Logger.Log("msg", "executed result", "result", vm.stack.data[vm.stack.sp])
-	// }
-	// fmt.Printf("state => %+v\n", bc.contractState.data)
+	tip, err := bc.GetHeader(bc.Height())
+	if err != nil {
+		return err
+	}
+	if b.PrevBlockHash != (BlockHasher{}).Hash(tip) {
+		bc.addSideBlock(b)
+		if !bc.forkChoice.Prefer(tip, b.Header) {
+			bc.Logger.Log("msg", "block added to side branch", "height", b.Height, "hash", b.Hash(BlockHasher{}))
+			return nil
+		}
+		reorg, err := bc.reorg(b)
+		if err != nil {
+			return err
+		}
+		bc.events.send(ReorgEvent{Reorg: reorg})
+		bc.sendBlockEvents(reorg.NewBranch...)
+		return nil
+	}
 
-	return bc.addBlockWithoutValidation(b)
+	if err := bc.applyBlock(b); err != nil {
+		return err
+	}
+	bc.pruneSideBlocks()
+	bc.sendBlockEvents(b)
+	return nil
 }
 
 func (bc *BlockChain) GetBlockByHash(hash types.Hash) (*Block, error) {
-	bc.lock.Lock()
-	defer bc.lock.Unlock()
-	block, ok := bc.blockStore[hash]
-	if !ok {
-		return nil, fmt.Errorf("block with hash (%s) not found", hash)
+	b, err := bc.store.GetByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	bc.cache.Add(b.Height, b)
+	return b, nil
+}
+
+// GetHeaderByHash returns the header of a known block, on the canonical
+// chain or on a side branch.
+func (bc *BlockChain) GetHeaderByHash(hash types.Hash) (*Header, error) {
+	bc.lock.RLock()
+	b, ok := bc.sideBlocks[hash]
+	bc.lock.RUnlock()
+	if ok {
+		return b.Header, nil
+	}
+	b, err := bc.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
 	}
-	return block, nil
+	return b.Header, nil
+}
+
+// HasBlockHash reports whether the block is known, on the canonical chain or
+// on a side branch.
+func (bc *BlockChain) HasBlockHash(hash types.Hash) bool {
+	_, err := bc.GetHeaderByHash(hash)
+	return err == nil
 }
 
 func (bc *BlockChain) GetTxByHash(hash types.Hash) (*Transaction, error) {
-	bc.lock.Lock()
-	defer bc.lock.Unlock()
-	tx, ok := bc.txStore[hash]
-	if !ok {
-		return nil, fmt.Errorf("could not find tx with hash (%s)", hash)
+	tx, _, err := bc.store.GetTx(hash)
+	return tx, err
+}
+
+// GetTxLocation returns where in the chain the given transaction was included.
+func (bc *BlockChain) GetTxLocation(hash types.Hash) (*TxLocation, error) {
+	_, loc, err := bc.store.GetTx(hash)
+	return loc, err
+}
+
+// GetReceipt returns the receipt of a transaction on the canonical chain.
+func (bc *BlockChain) GetReceipt(hash types.Hash) (*Receipt, error) {
+	_, loc, err := bc.store.GetTx(hash)
+	if err != nil {
+		return nil, err
 	}
-	return tx, nil
+	receipts, err := bc.store.GetReceipts(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	if int(loc.Index) >= len(receipts) {
+		return nil, fmt.Errorf("no receipt for tx with hash (%s)", hash)
+	}
+	return receipts[loc.Index], nil
+}
+
+// GetReceipts returns the receipts of all transactions of the block at the
+// given height.
+func (bc *BlockChain) GetReceipts(height uint32) ([]*Receipt, error) {
+	if height > bc.Height() {
+		return nil, fmt.Errorf("given height (%d) too high", height)
+	}
+	return bc.store.GetReceipts(height)
 }
 
 func (bc *BlockChain) GetHeader(height uint32) (*Header, error) {
-	bc.lock.RLock()
 	if height > bc.Height() {
 		return nil, fmt.Errorf("given height %d is greater than the blockchain height %d", height, bc.Height())
 	}
-	// whether defer
-	bc.lock.RUnlock()
-	return bc.headers[height], nil
+	b, err := bc.GetBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	return b.Header, nil
 }
 
 func (bc *BlockChain) HasBlock(h uint32) bool {
@@ -92,27 +411,59 @@ func (bc *BlockChain) HasBlock(h uint32) bool {
 func (bc *BlockChain) Height() uint32 {
 	bc.lock.RLock()
 	defer bc.lock.RUnlock()
-	return uint32(len(bc.headers) - 1)
+	return bc.height
 }
 
 func (bc *BlockChain) addBlockWithoutValidation(b *Block) error {
-	bc.lock.Lock()
-	bc.headers = append(bc.headers, b.Header)
-	bc.blocks = append(bc.blocks, b)
-	bc.lock.Unlock()
-
-	bc.blockStore[b.Hash(BlockHasher{})] = b
-	for _, tx := range b.Transactions {
-		bc.txStore[tx.Hash(TxHasher{})] = tx
+	// persist first, a block that failed to be written must not become
+	// visible in the chain.
+	if err := bc.store.Put(b); err != nil {
+		return err
 	}
-	return bc.store.Put(b)
+	bc.indexBlock(b)
+	return nil
+}
+
+func (bc *BlockChain) indexBlock(b *Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.height = b.Height
+	bc.cache.Add(b.Height, b)
 }
 
 func (bc *BlockChain) GetBlock(height uint32) (*Block, error) {
-	if height > bc.Height() {
+	bc.lock.RLock()
+	tip, rewinds := bc.height, bc.rewinds
+	bc.lock.RUnlock()
+	if height > tip {
 		return nil, fmt.Errorf("given height (%d) too high", height)
 	}
+	if b, ok := bc.cache.Get(height); ok {
+		return b, nil
+	}
+	b, err := bc.store.Get(height)
+	if err != nil {
+		return nil, err
+	}
+	bc.cacheBlock(b, rewinds)
+	return b, nil
+}
+
+// cacheBlock adds a block read from the store to the cache, unless the
+// chain was rewound since the read started.
+func (bc *BlockChain) cacheBlock(b *Block, rewinds uint64) {
 	bc.lock.Lock()
 	defer bc.lock.Unlock()
-	return bc.blocks[height], nil
+	if bc.rewinds == rewinds && b.Height <= bc.height {
+		bc.cache.Add(b.Height, b)
+	}
+}
+
+// RangeBlocks calls fn for every block from height from up to and including
+// height to, reading them straight from the store.
+func (bc *BlockChain) RangeBlocks(from, to uint32, fn func(*Block) error) error {
+	if to > bc.Height() {
+		return fmt.Errorf("given height (%d) too high", to)
+	}
+	return bc.store.Range(from, to, fn)
 }
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"myblockchain/crypto"
 	"myblockchain/types"
 	"os"
 	"testing"
@@ -20,7 +21,7 @@ func NewBlockChainWithGenesis(t *testing.T) *BlockChain {
 func TestAddBlock(t *testing.T) {
 	bc := NewBlockChainWithGenesis(t)
 	for i := 0; i < 100; i++ {
-		b := randBlock(t, uint32(i+1), getPrevBlockHash(t, bc, uint32(i+1)))
+		b := nextBlock(t, bc)
 		err := bc.AddBlock(b)
 		assert.Nil(t, err)
 	}
@@ -42,7 +43,7 @@ func TestHasBlock(t *testing.T) {
 func TestGetHeader(t *testing.T) {
 	bc := NewBlockChainWithGenesis(t)
 	for i := 0; i < 100; i++ {
-		b := randBlock(t, uint32(i+1), getPrevBlockHash(t, bc, uint32(i+1)))
+		b := nextBlock(t, bc)
 		assert.Nil(t, bc.AddBlock(b))
 		header, err := bc.GetHeader(b.Height)
 		assert.Nil(t, err)
@@ -52,25 +53,84 @@ func TestGetHeader(t *testing.T) {
 
 func TestAddBlockToHigh(t *testing.T) {
 	bc := NewBlockChainWithGenesis(t)
-	assert.Nil(t, bc.AddBlock(randBlock(t, 1, getPrevBlockHash(t, bc, uint32(1)))))
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
 	assert.NotNil(t, bc.AddBlock(randBlock(t, 3, types.Hash{})))
 
 }
 
-func getPrevBlockHash(t *testing.T, bc *BlockChain, height uint32) types.Hash {
-	prevheader, err := bc.GetHeader(height - 1)
+// proposeBlock builds a valid block with the given transactions on top of
+// the tip of the chain, signed by a random proposer.
+func proposeBlock(t *testing.T, bc *BlockChain, txs ...*Transaction) *Block {
+	b, err := bc.ProposeBlock(crypto.GeneratePrivateKey(), txs)
 	assert.Nil(t, err)
-	return BlockHasher{}.Hash(prevheader)
+	return b
+}
+
+// nextBlock builds a valid block with a random transaction on top of the
+// tip of the chain.
+func nextBlock(t *testing.T, bc *BlockChain) *Block {
+	return proposeBlock(t, bc, randomTxWithSignature(t))
+}
+
+// newBuilder returns an empty copy of the chain. Blocks of other branches
+// are built on the copy, so their roots match their own parents.
+func newBuilder(t *testing.T, bc *BlockChain) *BlockChain {
+	opts := BlockChainOptions{Logger: log.NewNopLogger(), ForkChoice: LongestChain{}}
+	if bc.Genesis() != nil {
+		builder, err := NewBlockChainFromGenesis(opts, bc.Genesis())
+		assert.Nil(t, err)
+		return builder
+	}
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	builder, err := NewBlockChainWithOptions(opts, genesis)
+	assert.Nil(t, err)
+	return builder
 }
 
 func TestGetBlock(t *testing.T) {
 	bc := NewBlockChainWithGenesis(t)
 	lenBlocks := 100
 	for i := 0; i < lenBlocks; i++ {
-		block := randBlock(t, uint32(i+1), getPrevBlockHash(t, bc, uint32(i+1)))
+		block := nextBlock(t, bc)
 		assert.Nil(t, bc.AddBlock(block))
 		fetchedBlock, err := bc.GetBlock(block.Height)
 		assert.Nil(t, err)
 		assert.Equal(t, fetchedBlock, block)
 	}
 }
+
+func TestBlockCacheIsBounded(t *testing.T) {
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{CacheSize: 10}, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	}
+	assert.Equal(t, 10, bc.cache.Len())
+	b, err := bc.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), b.Height)
+	assert.Equal(t, 10, bc.cache.Len())
+}
+
+func TestReopenChecksEveryLink(t *testing.T) {
+	genesis := randBlock(t, 0, types.Hash{})
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{}, genesis)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	}
+
+	// the tip still links to its parent, the block below it does not
+	store := NewMemoryStore()
+	for height := uint32(0); height <= bc.Height(); height++ {
+		b, err := bc.GetBlock(height)
+		assert.Nil(t, err)
+		if height == 1 {
+			b = randBlock(t, 1, types.Hash{0x1})
+		}
+		assert.Nil(t, store.Put(b))
+	}
+	_, err = NewBlockChainWithOptions(BlockChainOptions{Store: store}, genesis)
+	assert.ErrorIs(t, err, ErrStoreCorrupted)
+}
@@ -0,0 +1,454 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"myblockchain/crypto"
+	"myblockchain/types"
+)
+
+// CodecVersion is the first byte of everything encoded with the binary
+// codec. The layout of version 1:
+//
+//	header      = Version u32 | ChainID u32 | DataHash [32] | PrevBlockHash [32] |
+//	              StateRoot [32] | ReceiptsRoot [32] | Proposer [20] | Timestamp u64 |
+//	              Height u32 | Extra bytes
+//	transaction = Type u8 | ChainID u32 | Nonce u64 | To [20] | Value u64 | Fee u64 |
+//	              ValidUntilHeight u32 | ValidUntilTime u64 | Data bytes | From bytes |
+//	              Signature sig
+//	block       = header | Validator bytes | Signature sig | count u32 | transaction...
+//	bytes       = length u32 | data
+//	sig         = 0x00 if absent, 0x01 | R [32] | S [32] if present
+//
+// All integers are big endian, nothing is optional beyond the marked fields
+// and there are no trailing bytes, so every value has exactly one encoding.
+const CodecVersion byte = 0x01
+
+const (
+	maxCodecBytes = 16 << 20
+	maxCodecTxs   = 1 << 20
+	signatureSize = 32
+)
+
+var ErrInvalidEncoding = errors.New("invalid encoding")
+
+type BinaryTxEncoder struct {
+	w io.Writer
+}
+
+func NewBinaryTxEncoder(w io.Writer) *BinaryTxEncoder {
+	return &BinaryTxEncoder{w: w}
+}
+
+func (e *BinaryTxEncoder) Encode(tx *Transaction) error {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.tx(tx)
+	return enc.flush(e.w)
+}
+
+// BinaryTxDecoder decodes a transaction from a reader that holds exactly
+// one, it fails on anything that follows it.
+type BinaryTxDecoder struct {
+	r io.Reader
+}
+
+func NewBinaryTxDecoder(r io.Reader) *BinaryTxDecoder {
+	return &BinaryTxDecoder{r: r}
+}
+
+func (d *BinaryTxDecoder) Decode(tx *Transaction) error {
+	dec := &codecReader{r: d.r}
+	dec.version()
+	dec.tx(tx)
+	dec.end()
+	return dec.err
+}
+
+type BinaryBlockEncoder struct {
+	w io.Writer
+}
+
+func NewBinaryBlockEncoder(w io.Writer) *BinaryBlockEncoder {
+	return &BinaryBlockEncoder{w: w}
+}
+
+func (e *BinaryBlockEncoder) Encode(b *Block) error {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.block(b)
+	return enc.flush(e.w)
+}
+
+// BinaryBlockDecoder decodes a block from a reader that holds exactly one,
+// it fails on anything that follows it.
+type BinaryBlockDecoder struct {
+	r io.Reader
+}
+
+func NewBinaryBlockDecoder(r io.Reader) *BinaryBlockDecoder {
+	return &BinaryBlockDecoder{r: r}
+}
+
+func (d *BinaryBlockDecoder) Decode(b *Block) error {
+	dec := &codecReader{r: d.r}
+	dec.version()
+	dec.block(b)
+	dec.end()
+	return dec.err
+}
+
+// MarshalBinary makes gob, and with it every message that carries blocks,
+// use the binary codec.
+func (b *Block) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := NewBinaryBlockEncoder(buf).Encode(b)
+	return buf.Bytes(), err
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	return NewBinaryBlockDecoder(bytes.NewReader(data)).Decode(b)
+}
+
+func (tx *Transaction) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := NewBinaryTxEncoder(buf).Encode(tx)
+	return buf.Bytes(), err
+}
+
+func (tx *Transaction) UnmarshalBinary(data []byte) error {
+	return NewBinaryTxDecoder(bytes.NewReader(data)).Decode(tx)
+}
+
+func (h *SignedHeader) MarshalBinary() ([]byte, error) {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.header(h.Header)
+	enc.bytes(h.Validator)
+	enc.signature(h.Signature)
+	return enc.buf.Bytes(), enc.err
+}
+
+func (h *SignedHeader) UnmarshalBinary(data []byte) error {
+	dec := &codecReader{r: bytes.NewReader(data)}
+	dec.version()
+	h.Header = new(Header)
+	dec.header(h.Header)
+	h.Validator = dec.bytes()
+	h.Signature = dec.signature()
+	dec.end()
+	return dec.err
+}
+
+// encodeHeader returns the canonical encoding of the header that is hashed
+// and signed.
+func encodeHeader(h *Header) []byte {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.header(h)
+	return enc.buf.Bytes()
+}
+
+// encodeTxPayload returns the canonical encoding of the transaction without
+// its signature, which is what is hashed and signed.
+func encodeTxPayload(tx *Transaction) []byte {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.txPayload(tx)
+	return enc.buf.Bytes()
+}
+
+// encodedTxSize returns the size of the transaction inside an encoded block.
+func encodedTxSize(tx *Transaction) int {
+	enc := newCodecWriter()
+	enc.tx(tx)
+	return enc.buf.Len()
+}
+
+// codecWriter remembers the first error, so encoding a value is a plain
+// sequence of writes that is checked once at the end.
+type codecWriter struct {
+	buf *bytes.Buffer
+	err error
+}
+
+func newCodecWriter() *codecWriter {
+	return &codecWriter{buf: &bytes.Buffer{}}
+}
+
+func (w *codecWriter) flush(out io.Writer) error {
+	if w.err != nil {
+		return w.err
+	}
+	_, err := out.Write(w.buf.Bytes())
+	return err
+}
+
+func (w *codecWriter) byte(b byte) {
+	w.buf.WriteByte(b)
+}
+
+func (w *codecWriter) uint32(v uint32) {
+	w.buf.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (w *codecWriter) uint64(v uint64) {
+	w.buf.Write(binary.BigEndian.AppendUint64(nil, v))
+}
+
+func (w *codecWriter) hash(h types.Hash) {
+	w.buf.Write(h[:])
+}
+
+func (w *codecWriter) bytes(b []byte) {
+	if len(b) > maxCodecBytes {
+		w.fail(fmt.Errorf("%w: %d bytes exceed the limit", ErrInvalidEncoding, len(b)))
+		return
+	}
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *codecWriter) signature(sig *crypto.Signature) {
+	if sig == nil {
+		w.byte(0x0)
+		return
+	}
+	if sig.R == nil || sig.S == nil || sig.R.Sign() < 0 || sig.S.Sign() < 0 ||
+		sig.R.BitLen() > 8*signatureSize || sig.S.BitLen() > 8*signatureSize {
+		w.fail(fmt.Errorf("%w: signature out of range", ErrInvalidEncoding))
+		return
+	}
+	w.byte(0x1)
+	w.buf.Write(sig.R.FillBytes(make([]byte, signatureSize)))
+	w.buf.Write(sig.S.FillBytes(make([]byte, signatureSize)))
+}
+
+func (w *codecWriter) header(h *Header) {
+	if h == nil {
+		w.fail(fmt.Errorf("%w: missing header", ErrInvalidEncoding))
+		return
+	}
+	w.uint32(h.Version)
+	w.uint32(h.ChainID)
+	w.hash(h.DataHash)
+	w.hash(h.PrevBlockHash)
+	w.hash(h.StateRoot)
+	w.hash(h.ReceiptsRoot)
+	w.address(h.Proposer)
+	w.uint64(h.Timestamp)
+	w.uint32(h.Height)
+	w.bytes(h.Extra)
+}
+
+func (w *codecWriter) address(a types.Address) {
+	w.buf.Write(a[:])
+}
+
+func (w *codecWriter) txPayload(tx *Transaction) {
+	w.byte(byte(tx.Type))
+	w.uint32(tx.ChainID)
+	w.uint64(tx.Nonce)
+	w.address(tx.To)
+	w.uint64(tx.Value)
+	w.uint64(tx.Fee)
+	w.uint32(tx.ValidUntilHeight)
+	w.uint64(tx.ValidUntilTime)
+	w.bytes(tx.Data)
+	w.bytes(tx.From)
+}
+
+func (w *codecWriter) tx(tx *Transaction) {
+	w.txPayload(tx)
+	w.signature(tx.Signature)
+}
+
+func (w *codecWriter) block(b *Block) {
+	w.header(b.Header)
+	w.bytes(b.Validatar)
+	w.signature(b.Signature)
+	w.uint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		w.tx(tx)
+	}
+}
+
+func (w *codecWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// codecReader is the counterpart of codecWriter, it rejects everything that
+// is not the canonical encoding of a value.
+type codecReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *codecReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		r.err = err
+		return nil
+	}
+	return buf
+}
+
+func (r *codecReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// end fails unless the value just read was the last thing in the reader.
+func (r *codecReader) end() {
+	if r.err != nil {
+		return
+	}
+	buf := make([]byte, 1)
+	for {
+		n, err := r.r.Read(buf)
+		switch {
+		case n > 0:
+			r.fail(fmt.Errorf("%w: trailing bytes", ErrInvalidEncoding))
+		case err == nil:
+			continue
+		case err != io.EOF:
+			r.fail(err)
+		}
+		return
+	}
+}
+
+func (r *codecReader) byte() byte {
+	b := r.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *codecReader) version() {
+	if v := r.byte(); r.err == nil && v != CodecVersion {
+		r.fail(fmt.Errorf("%w: unsupported codec version (%d)", ErrInvalidEncoding, v))
+	}
+}
+
+func (r *codecReader) uint32() uint32 {
+	b := r.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *codecReader) uint64() uint64 {
+	b := r.read(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *codecReader) hash() types.Hash {
+	b := r.read(32)
+	if b == nil {
+		return types.Hash{}
+	}
+	return types.HashFromBytes(b)
+}
+
+func (r *codecReader) address() types.Address {
+	b := r.read(20)
+	if b == nil {
+		return types.Address{}
+	}
+	return types.AddressFromBytes(b)
+}
+
+func (r *codecReader) bytes() []byte {
+	n := r.uint32()
+	if n > maxCodecBytes {
+		r.fail(fmt.Errorf("%w: %d bytes exceed the limit", ErrInvalidEncoding, n))
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	return r.read(int(n))
+}
+
+func (r *codecReader) signature() *crypto.Signature {
+	switch flag := r.byte(); {
+	case r.err != nil, flag == 0x0:
+		return nil
+	case flag != 0x1:
+		r.fail(fmt.Errorf("%w: invalid signature flag (%d)", ErrInvalidEncoding, flag))
+		return nil
+	}
+	R, S := r.read(signatureSize), r.read(signatureSize)
+	if r.err != nil {
+		return nil
+	}
+	return &crypto.Signature{R: new(big.Int).SetBytes(R), S: new(big.Int).SetBytes(S)}
+}
+
+func (r *codecReader) header(h *Header) {
+	h.Version = r.uint32()
+	h.ChainID = r.uint32()
+	h.DataHash = r.hash()
+	h.PrevBlockHash = r.hash()
+	h.StateRoot = r.hash()
+	h.ReceiptsRoot = r.hash()
+	h.Proposer = r.address()
+	h.Timestamp = r.uint64()
+	h.Height = r.uint32()
+	h.Extra = r.bytes()
+}
+
+func (r *codecReader) tx(tx *Transaction) {
+	*tx = Transaction{
+		Type:             TxType(r.byte()),
+		ChainID:          r.uint32(),
+		Nonce:            r.uint64(),
+		To:               r.address(),
+		Value:            r.uint64(),
+		Fee:              r.uint64(),
+		ValidUntilHeight: r.uint32(),
+		ValidUntilTime:   r.uint64(),
+		Data:             r.bytes(),
+		From:             r.bytes(),
+		Signature:        r.signature(),
+	}
+}
+
+func (r *codecReader) block(b *Block) {
+	h := new(Header)
+	r.header(h)
+	*b = Block{
+		Header:    h,
+		Validatar: r.bytes(),
+		Signature: r.signature(),
+	}
+	n := r.uint32()
+	if r.err != nil {
+		return
+	}
+	if n > maxCodecTxs {
+		r.fail(fmt.Errorf("%w: %d transactions exceed the limit", ErrInvalidEncoding, n))
+		return
+	}
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		tx := new(Transaction)
+		r.tx(tx)
+		b.Transactions = append(b.Transactions, tx)
+	}
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"myblockchain/crypto"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type codecVector struct {
+	Name string `json:"name"`
+	// Hex is the encoding of the value, Hash its block or tx hash.
+	Hex  string `json:"hex"`
+	Hash string `json:"hash"`
+}
+
+func vectorSignature(r, s byte) *crypto.Signature {
+	return &crypto.Signature{
+		R: new(big.Int).SetBytes(bytes.Repeat([]byte{r}, 32)),
+		S: new(big.Int).SetBytes([]byte{s}),
+	}
+}
+
+func vectorKey(b byte) crypto.PublicKey {
+	return append([]byte{0x02}, bytes.Repeat([]byte{b}, 32)...)
+}
+
+func vectorHeader() *Header {
+	return &Header{
+		Version:       1,
+		ChainID:       7,
+		DataHash:      sha256.Sum256([]byte("data")),
+		PrevBlockHash: sha256.Sum256([]byte("prev")),
+		StateRoot:     sha256.Sum256([]byte("state")),
+		ReceiptsRoot:  sha256.Sum256([]byte("receipts")),
+		Proposer:      vectorKey(0xcc).Address(),
+		Timestamp:     1700000000000000000,
+		Height:        42,
+		Extra:         []byte("extra"),
+	}
+}
+
+func vectorTx() *Transaction {
+	return &Transaction{
+		Type:             TxTypeCall,
+		ChainID:          7,
+		Nonce:            3,
+		To:               vectorKey(0xdd).Address(),
+		Value:            1000,
+		Fee:              10,
+		Data:             []byte("hello"),
+		ValidUntilHeight: 100,
+		ValidUntilTime:   1700000000000000000,
+		From:             vectorKey(0xaa),
+		Signature:        vectorSignature(0x11, 0x22),
+	}
+}
+
+func vectorBlock() *Block {
+	return &Block{
+		Header:       vectorHeader(),
+		Transactions: []*Transaction{vectorTx(), {Data: []byte{0x01}}},
+		Validatar:    vectorKey(0xbb),
+		Signature:    vectorSignature(0x33, 0x44),
+	}
+}
+
+// encodeVector returns the encoding and the hash of the named vector.
+func encodeVector(t *testing.T, name string) ([]byte, []byte) {
+	buf := &bytes.Buffer{}
+	switch name {
+	case "header":
+		h := vectorHeader()
+		hash := BlockHasher{}.Hash(h)
+		return h.Bytes(), hash[:]
+	case "transaction", "unsigned transaction":
+		tx := vectorTx()
+		if name == "unsigned transaction" {
+			tx = &Transaction{}
+		}
+		assert.Nil(t, tx.Encode(NewBinaryTxEncoder(buf)))
+		hash := tx.Hash(TxHasher{})
+		return buf.Bytes(), hash[:]
+	case "block":
+		b := vectorBlock()
+		assert.Nil(t, b.Encode(NewBinaryBlockEncoder(buf)))
+		hash := b.Hash(BlockHasher{})
+		return buf.Bytes(), hash[:]
+	}
+	t.Fatalf("unknown vector %q", name)
+	return nil, nil
+}
+
+func TestCodecVectors(t *testing.T) {
+	raw, err := os.ReadFile("testdata/codec_vectors.json")
+	assert.Nil(t, err)
+	vectors := []codecVector{}
+	assert.Nil(t, json.Unmarshal(raw, &vectors))
+	assert.Len(t, vectors, 4)
+
+	for _, v := range vectors {
+		encoded, hash := encodeVector(t, v.Name)
+		assert.Equal(t, v.Hex, hex.EncodeToString(encoded), v.Name)
+		assert.Equal(t, v.Hash, hex.EncodeToString(hash), v.Name)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	b := vectorBlock()
+	encoded, err := b.MarshalBinary()
+	assert.Nil(t, err)
+	decoded := new(Block)
+	assert.Nil(t, decoded.UnmarshalBinary(encoded))
+	assert.Equal(t, b.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+	assert.Equal(t, b.Transactions[0].Data, decoded.Transactions[0].Data)
+	assert.Equal(t, b.Signature.R, decoded.Signature.R)
+	reencoded, err := decoded.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, encoded, reencoded)
+
+	h := &SignedHeader{Header: vectorHeader(), Validator: vectorKey(0xcc), Signature: vectorSignature(0x1, 0x2)}
+	encoded, err = h.MarshalBinary()
+	assert.Nil(t, err)
+	decodedHeader := new(SignedHeader)
+	assert.Nil(t, decodedHeader.UnmarshalBinary(encoded))
+	assert.Equal(t, h.Hash(), decodedHeader.Hash())
+	assert.Equal(t, h.Validator, decodedHeader.Validator)
+}
+
+func TestCodecRejectsNonCanonical(t *testing.T) {
+	encoded, err := vectorTx().MarshalBinary()
+	assert.Nil(t, err)
+	tx := new(Transaction)
+
+	assert.ErrorIs(t, tx.UnmarshalBinary(append(encoded, 0x0)), ErrInvalidEncoding)
+	assert.ErrorIs(t, NewBinaryTxDecoder(bytes.NewReader(append(encoded, 0x0))).Decode(tx), ErrInvalidEncoding)
+	block, err := vectorBlock().MarshalBinary()
+	assert.Nil(t, err)
+	assert.ErrorIs(t, NewBinaryBlockDecoder(bytes.NewReader(append(block, 0x0))).Decode(new(Block)), ErrInvalidEncoding)
+	assert.NotNil(t, tx.UnmarshalBinary(encoded[:len(encoded)-1]))
+
+	badVersion := append([]byte{}, encoded...)
+	badVersion[0] = CodecVersion + 1
+	assert.ErrorIs(t, tx.UnmarshalBinary(badVersion), ErrInvalidEncoding)
+
+	// the signature flag follows the fixed size fields, the data and the key
+	badFlag := append([]byte{}, encoded...)
+	badFlag[1+1+4+8+20+8+8+4+8+4+5+4+33] = 0x2
+	assert.ErrorIs(t, tx.UnmarshalBinary(badFlag), ErrInvalidEncoding)
+
+	tooLarge := &Transaction{Signature: &crypto.Signature{R: new(big.Int).Lsh(big.NewInt(1), 256), S: big.NewInt(1)}}
+	_, err = tooLarge.MarshalBinary()
+	assert.ErrorIs(t, err, ErrInvalidEncoding)
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"myblockchain/types"
+	"strings"
+)
+
+// Contract is the metadata the state holds for every deployed contract,
+// next to its code.
+type Contract struct {
+	CodeHash types.Hash
+	Owner    types.Address
+	// Height is the height of the block the contract was deployed in.
+	Height uint32
+}
+
+const contractSize = 32 + 20 + 4
+
+func (c *Contract) Bytes() []byte {
+	buf := make([]byte, 0, contractSize)
+	buf = append(buf, c.CodeHash[:]...)
+	buf = append(buf, c.Owner[:]...)
+	return binary.BigEndian.AppendUint32(buf, c.Height)
+}
+
+func contractKey(addr types.Address) []byte {
+	return append([]byte("contract/"), addr[:]...)
+}
+
+const storageKeyPrefix = "storage/"
+
+// storagePrefix is what the storage keys of a contract start with, every
+// contract writes to its own keyspace.
+func storagePrefix(addr types.Address) []byte {
+	return append([]byte(storageKeyPrefix), addr[:]...)
+}
+
+func isStorageKey(key string) bool {
+	return strings.HasPrefix(key, storageKeyPrefix)
+}
+
+func storageKey(addr types.Address, key []byte) []byte {
+	return append(storagePrefix(addr), key...)
+}
+
+// deployContract stores the code and the metadata of a new contract.
+func (s *State) deployContract(addr, owner types.Address, code []byte, height uint32) error {
+	if _, err := s.Get(codeKey(addr)); err == nil {
+		return fmt.Errorf("contract %s already exists", addr)
+	}
+	c := &Contract{CodeHash: sha256.Sum256(code), Owner: owner, Height: height}
+	if err := s.Put(contractKey(addr), c.Bytes()); err != nil {
+		return err
+	}
+	return s.Put(codeKey(addr), code)
+}
+
+// GetContract returns the metadata of the contract at the address.
+func (s *State) GetContract(addr types.Address) (*Contract, error) {
+	b, err := s.Get(contractKey(addr))
+	if err != nil {
+		return nil, fmt.Errorf("no contract at %s", addr)
+	}
+	if len(b) != contractSize {
+		return nil, fmt.Errorf("contract %s has invalid encoding", addr)
+	}
+	return &Contract{
+		CodeHash: types.HashFromBytes(b[:32]),
+		Owner:    types.AddressFromBytes(b[32:52]),
+		Height:   binary.BigEndian.Uint32(b[52:]),
+	}, nil
+}
+
+// ContractStorage returns every key the contract at the address stored,
+// without the prefix of its keyspace, and its value. Only the keys of the
+// contract are visited.
+func (s *State) ContractStorage(addr types.Address) map[string][]byte {
+	prefix := string(storagePrefix(addr))
+	storage := make(map[string][]byte)
+	s.storage.scan(prefix, func(key string) {
+		if value, err := s.Get([]byte(key)); err == nil {
+			storage[key[len(prefix):]] = value
+		}
+	})
+	return storage
+}
+
+// isReservedKey reports whether the key belongs to the accounts, the
+// contracts or their storage, which scripts cannot write.
+func isReservedKey(key []byte) bool {
+	for _, prefix := range []string{"account/", "code/", "contract/", "storage/"} {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetContract returns the metadata of the contract at the address at the
+// tip of the chain.
+func (bc *BlockChain) GetContract(addr types.Address) (*Contract, error) {
+	return bc.StateView().GetContract(addr)
+}
+
+// GetContractStorage returns the storage of the contract at the address at
+// the tip of the chain.
+func (bc *BlockChain) GetContractStorage(addr types.Address) (map[string][]byte, error) {
+	view := bc.StateView()
+	if _, err := view.GetContract(addr); err != nil {
+		return nil, err
+	}
+	return view.ContractStorage(addr), nil
+}
+
+// GetContractValue returns the value the contract at the address stored
+// under the key at the tip of the chain.
+func (bc *BlockChain) GetContractValue(addr types.Address, key []byte) ([]byte, error) {
+	view := bc.StateView()
+	if _, err := view.GetContract(addr); err != nil {
+		return nil, err
+	}
+	return view.Get(storageKey(addr, key))
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"crypto/sha256"
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContractStorageIsScoped(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+
+	// both contracts store 7 under the key they are called with
+	code := []byte{0x7, byte(InstrPushInt), byte(InstrStore)}
+	deployA := &Transaction{Type: TxTypeDeploy, Data: code}
+	assert.Nil(t, deployA.Sign(alice))
+	deployB := &Transaction{Type: TxTypeDeploy, Data: code}
+	assert.Nil(t, deployB.Sign(bob))
+	mustAdd(t, bc, proposeBlock(t, bc, deployA, deployB))
+	a := ContractAddress(alice.PublicKey().Address(), 0)
+	b := ContractAddress(bob.PublicKey().Address(), 0)
+
+	contract, err := bc.GetContract(a)
+	assert.Nil(t, err)
+	assert.Equal(t, &Contract{CodeHash: sha256.Sum256(code), Owner: alice.PublicKey().Address(), Height: 1}, contract)
+
+	callA := &Transaction{Type: TxTypeCall, To: a, Data: []byte("foo")}
+	assert.Nil(t, callA.Sign(crypto.GeneratePrivateKey()))
+	callB := &Transaction{Type: TxTypeCall, To: b, Data: []byte("bar")}
+	assert.Nil(t, callB.Sign(crypto.GeneratePrivateKey()))
+	// a script cannot reach into the storage of a contract
+	script := &Transaction{Data: storeCode("storage/foo", 1)}
+	assert.Nil(t, script.Sign(crypto.GeneratePrivateKey()))
+	mustAdd(t, bc, proposeBlock(t, bc, callA, callB, script))
+
+	receipt, err := bc.GetReceipt(script.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, receipt.Status)
+
+	storage, err := bc.GetContractStorage(a)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"foo": serializeInt64(7)}, storage)
+	value, err := bc.GetContractValue(b, []byte("bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, serializeInt64(7), value)
+	_, err = bc.GetContractValue(b, []byte("foo"))
+	assert.NotNil(t, err)
+
+	_, err = bc.GetContractStorage(alice.PublicKey().Address())
+	assert.NotNil(t, err)
+}
+
+func TestContractStorageVisitsOnlyTheContract(t *testing.T) {
+	storageOf := func(others int) (*State, types.Address) {
+		s := NewState()
+		addr := types.Address{0x1}
+		for i := 0; i < 5; i++ {
+			assert.Nil(t, s.Put(storageKey(addr, []byte{byte(i)}), []byte{byte(i)}))
+		}
+		for i := 0; i < others; i++ {
+			other := types.Address{0x2, byte(i >> 8), byte(i)}
+			assert.Nil(t, s.Put(storageKey(other, []byte("foo")), []byte("bar")))
+		}
+		return s, addr
+	}
+
+	s, addr := storageOf(100)
+	snapshot := s.Snapshot()
+	assert.Nil(t, s.Delete(string(storageKey(addr, []byte{0}))))
+	assert.Len(t, s.ContractStorage(addr), 4)
+	assert.Nil(t, s.RevertToSnapshot(snapshot))
+	assert.Len(t, s.ContractStorage(addr), 5)
+	assert.Equal(t, []byte{3}, s.View().ContractStorage(addr)[string([]byte{3})])
+
+	small := testing.AllocsPerRun(10, func() { s.ContractStorage(addr) })
+	s, addr = storageOf(10000)
+	large := testing.AllocsPerRun(10, func() { s.ContractStorage(addr) })
+	assert.Equal(t, small, large)
+}
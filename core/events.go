@@ -0,0 +1,177 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const defaultSubscriptionBuffer = 64
+
+// Event is a change of the chain, one of NewHeadEvent, BlockAddedEvent,
+// ReorgEvent or TxIncludedEvent.
+type Event interface {
+	chainEvent()
+}
+
+// NewHeadEvent is sent when the canonical tip changes.
+type NewHeadEvent struct {
+	Block *Block
+}
+
+// BlockAddedEvent is sent for every block that becomes part of the canonical
+// chain, including the blocks of a branch the chain switched to.
+type BlockAddedEvent struct {
+	Block    *Block
+	Receipts []*Receipt
+}
+
+// ReorgEvent is sent when the canonical chain switches to another branch,
+// before the events of the blocks of the new branch.
+type ReorgEvent struct {
+	Reorg *Reorg
+}
+
+// TxIncludedEvent is sent for every transaction of a block that becomes part
+// of the canonical chain.
+type TxIncludedEvent struct {
+	Tx      *Transaction
+	Receipt *Receipt
+}
+
+func (NewHeadEvent) chainEvent()    {}
+func (BlockAddedEvent) chainEvent() {}
+func (ReorgEvent) chainEvent()      {}
+func (TxIncludedEvent) chainEvent() {}
+
+// Subscription receives the events of a chain. Sending never blocks the
+// chain, events that do not fit into the buffer of a slow subscriber are
+// dropped and counted. Consumers that must not miss an event register a
+// handler instead, see BlockChain.Handle.
+type Subscription struct {
+	feed    *eventFeed
+	ch      chan Event
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Events returns the channel the events are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscriber did not keep up.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops the delivery of events and closes the channel.
+func (s *Subscription) Unsubscribe() {
+	s.feed.remove(s)
+}
+
+type eventFeed struct {
+	lock     sync.RWMutex
+	subs     map[*Subscription]struct{}
+	handlers []func(Event)
+	closed   bool
+}
+
+func newEventFeed() *eventFeed {
+	return &eventFeed{subs: make(map[*Subscription]struct{})}
+}
+
+func (f *eventFeed) subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = defaultSubscriptionBuffer
+	}
+	s := &Subscription{feed: f, ch: make(chan Event, buffer)}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		close(s.ch)
+		return s
+	}
+	f.subs[s] = struct{}{}
+	return s
+}
+
+func (f *eventFeed) remove(s *Subscription) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.subs, s)
+	s.once.Do(func() { close(s.ch) })
+}
+
+func (f *eventFeed) handle(fn func(Event)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.handlers = append(f.handlers, fn)
+}
+
+// send calls the handlers with the event before it is offered to the
+// subscribers.
+func (f *eventFeed) send(e Event) {
+	f.lock.RLock()
+	handlers := f.handlers
+	f.lock.RUnlock()
+	for _, fn := range handlers {
+		fn(e)
+	}
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for s := range f.subs {
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// close ends all subscriptions, later ones are closed right away.
+func (f *eventFeed) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.closed = true
+	for s := range f.subs {
+		delete(f.subs, s)
+		s.once.Do(func() { close(s.ch) })
+	}
+}
+
+// Subscribe returns a subscription to the events of the chain. buffer is the
+// number of events that can be pending before they are dropped, zero picks
+// a default.
+func (bc *BlockChain) Subscribe(buffer int) *Subscription {
+	return bc.events.subscribe(buffer)
+}
+
+// Handle registers fn to be called with every event of the chain, in order
+// and while the block the event is about is being added. Unlike a
+// subscriber, a handler never misses an event, so it has to be quick and
+// must not add blocks itself.
+func (bc *BlockChain) Handle(fn func(Event)) {
+	bc.events.handle(fn)
+}
+
+// sendBlockEvents announces blocks that became part of the canonical chain.
+func (bc *BlockChain) sendBlockEvents(blocks ...*Block) {
+	for _, b := range blocks {
+		receipts, err := bc.store.GetReceipts(b.Height)
+		if err != nil {
+			bc.Logger.Log("msg", "cannot read receipts for event", "height", b.Height, "err", err)
+		}
+		bc.events.send(BlockAddedEvent{Block: b, Receipts: receipts})
+		for i, tx := range b.Transactions {
+			var receipt *Receipt
+			if i < len(receipts) {
+				receipt = receipts[i]
+			}
+			bc.events.send(TxIncludedEvent{Tx: tx, Receipt: receipt})
+		}
+	}
+	bc.events.send(NewHeadEvent{Block: blocks[len(blocks)-1]})
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pendingEvents drains the events that were delivered so far.
+func pendingEvents(sub *Subscription) []Event {
+	events := []Event{}
+	for {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func pendingReorg(sub *Subscription) *Reorg {
+	for _, e := range pendingEvents(sub) {
+		if r, ok := e.(ReorgEvent); ok {
+			return r.Reorg
+		}
+	}
+	return nil
+}
+
+func TestBlockEvents(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	sub := bc.Subscribe(0)
+
+	b := blockWithCode(t, bc, storeCode("foo", 1), storeCode("bar", 2))
+	assert.Nil(t, bc.AddBlock(b))
+
+	events := pendingEvents(sub)
+	assert.Len(t, events, 4)
+	added, ok := events[0].(BlockAddedEvent)
+	assert.True(t, ok)
+	assert.Equal(t, b.Hash(BlockHasher{}), added.Block.Hash(BlockHasher{}))
+	assert.Len(t, added.Receipts, 2)
+	for i, e := range events[1:3] {
+		included, ok := e.(TxIncludedEvent)
+		assert.True(t, ok)
+		assert.Equal(t, b.Transactions[i], included.Tx)
+		assert.Equal(t, uint32(i), included.Receipt.TxIndex)
+	}
+	head, ok := events[3].(NewHeadEvent)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1), head.Block.Height)
+
+	sub.Unsubscribe()
+	_, open := <-sub.Events()
+	assert.False(t, open)
+	assert.Nil(t, bc.AddBlock(blockWithCode(t, bc)))
+}
+
+func TestSlowSubscriberDoesNotBlock(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	sub := bc.Subscribe(1)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, bc.AddBlock(blockWithCode(t, bc)))
+	}
+	assert.Len(t, pendingEvents(sub), 1)
+	assert.Equal(t, uint64(5), sub.Dropped())
+
+	assert.Nil(t, bc.Close())
+	_, open := <-sub.Events()
+	assert.False(t, open)
+	_, open = <-bc.Subscribe(0).Events()
+	assert.False(t, open)
+}
+
+func TestHandlerSeesEveryEvent(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	sub := bc.Subscribe(1)
+	handled := []Event{}
+	bc.Handle(func(e Event) { handled = append(handled, e) })
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, bc.AddBlock(blockWithCode(t, bc, storeCode("foo", byte(i)))))
+	}
+	assert.NotZero(t, sub.Dropped())
+	assert.Len(t, handled, 9)
+	for i := 0; i < 3; i++ {
+		added, ok := handled[3*i].(BlockAddedEvent)
+		assert.True(t, ok)
+		assert.Equal(t, uint32(i+1), added.Block.Height)
+	}
+}
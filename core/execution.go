@@ -0,0 +1,386 @@
+package core
+
+import (
+	"fmt"
+	"myblockchain/crypto"
+)
+
+// executeBlock executes every transaction of the block against a child of
+// the chain state. A transaction that fails has its writes reverted to a
+// snapshot taken before it ran and is marked as failed in its receipt, which
+// does not invalidate the block, so every node ends up with the same state.
+// A transaction with a bad nonce or a value or fee its sender cannot pay
+// does invalidate the block and the child state is dropped. The fees and
+// the block reward go to the proposer. Nothing is written to the chain
+// state until the returned state is committed.
+func (bc *BlockChain) executeBlock(b *Block) (*State, []*Receipt, *StateDiff, error) {
+	blockState := bc.contractState.Child()
+	start := blockState.Snapshot()
+	receipts := make([]*Receipt, len(b.Transactions))
+	diff := &StateDiff{
+		BlockHash: b.Hash(BlockHasher{}),
+		Height:    b.Height,
+		Txs:       make([]TxDiff, len(b.Transactions)),
+	}
+	for i := range b.Transactions {
+		snapshot := blockState.Snapshot()
+		receipt, err := bc.executeBlockTx(blockState, b.Header, i, b.Transactions[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		receipt.BlockHash = diff.BlockHash
+		receipts[i] = receipt
+		diff.Txs[i] = TxDiff{TxHash: receipt.TxHash, Changes: blockState.diffSince(snapshot)}
+		if err := blockState.DiscardSnapshot(snapshot); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if err := bc.rewardProposer(blockState, b.Header); err != nil {
+		return nil, nil, nil, err
+	}
+	diff.Changes = blockState.diffSince(start)
+	if err := blockState.DiscardSnapshot(start); err != nil {
+		return nil, nil, nil, err
+	}
+	return blockState, receipts, diff, nil
+}
+
+// rewardProposer credits the block reward to the proposer of the block.
+func (bc *BlockChain) rewardProposer(blockState *State, h *Header) error {
+	if err := blockState.credit(h.Proposer, bc.consensus().BlockReward); err != nil {
+		return fmt.Errorf("block (%d) reward: %w", h.Height, err)
+	}
+	return nil
+}
+
+// executeBlockTx executes the transaction at the given index of the block
+// with the given header against the block state. The state is left
+// untouched if an error is returned.
+func (bc *BlockChain) executeBlockTx(blockState *State, h *Header, i int, tx *Transaction) (*Receipt, error) {
+	if err := blockState.chargeTx(tx, h.Proposer); err != nil {
+		return nil, fmt.Errorf("block (%d) tx (%s): %w", h.Height, tx.Hash(TxHasher{}), err)
+	}
+	receipt := newReceipt(h, i, tx)
+	receipt.Fee = tx.Fee
+	snapshot := blockState.Snapshot()
+	if err := executeTx(tx, blockState, receipt); err != nil {
+		if err := blockState.RevertToSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+		receipt.Status = ReceiptFailed
+		receipt.Error = err.Error()
+		bc.Logger.Log("msg", "transaction failed", "hash", receipt.TxHash, "height", h.Height, "err", err)
+		return receipt, nil
+	}
+	receipt.Status = ReceiptSuccess
+	receipt.WrittenKeys = blockState.writtenKeys(snapshot)
+	if err := blockState.DiscardSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// executeTx runs the transaction against the given state according to its
+// type and fills in the cost and result of the receipt.
+func executeTx(tx *Transaction, s *State, receipt *Receipt) error {
+	switch tx.Type {
+	case TxTypeTransfer:
+		return s.transfer(tx.From.Address(), tx.To, tx.Value)
+	case TxTypeDeploy:
+		addr := ContractAddress(tx.From.Address(), tx.Nonce)
+		if err := s.deployContract(addr, tx.From.Address(), tx.Data, receipt.BlockHeight); err != nil {
+			return err
+		}
+		receipt.Result = addr.ToSlice()
+		return nil
+	case TxTypeCall:
+		code, err := s.Get(codeKey(tx.To))
+		if err != nil {
+			return fmt.Errorf("no contract at %s", tx.To)
+		}
+		if err := s.transfer(tx.From.Address(), tx.To, tx.Value); err != nil {
+			return err
+		}
+		return runCode(NewContractVM(code, s, tx.To), tx.Data, receipt)
+	default:
+		return runCode(NewVM(tx.Data, s), nil, receipt)
+	}
+}
+
+// runCode runs the VM, the input is pushed on the stack before the first
+// instruction.
+func runCode(vm *VM, input []byte, receipt *Receipt) error {
+	if len(input) > 0 {
+		if err := vm.push(input); err != nil {
+			return err
+		}
+	}
+	err := vm.Run()
+	receipt.Cost = vm.Cost()
+	if err != nil {
+		return err
+	}
+	receipt.Result = serializeResult(vm.Result())
+	return nil
+}
+
+// applyBlock executes the block, checks the outcome against its header,
+// persists it and commits its state. The block only joins the chain once it
+// is stored together with its receipts and state diff.
+func (bc *BlockChain) applyBlock(b *Block) error {
+	blockState, receipts, diff, err := bc.executeBlock(b)
+	if err != nil {
+		return err
+	}
+	if err := bc.validator.ValidateExecution(b, blockState, receipts); err != nil {
+		return err
+	}
+	if err := bc.storeBlock(b, receipts, diff); err != nil {
+		return err
+	}
+	bc.indexBlock(b)
+	bc.commitBlockState(b, blockState)
+	// the block is in the chain, without the checkpoint older states and
+	// restarts start from the one before it
+	if err := bc.checkpointState(b.Height); err != nil {
+		bc.Logger.Log("msg", "failed to store state checkpoint", "height", b.Height, "err", err)
+	}
+	return nil
+}
+
+// storeBlock persists the block, its receipts and its state diff. If one of
+// them cannot be written the block is removed from the store again.
+func (bc *BlockChain) storeBlock(b *Block, receipts []*Receipt, diff *StateDiff) error {
+	if err := bc.store.Put(b); err != nil {
+		return err
+	}
+	err := bc.store.PutReceipts(b.Height, receipts)
+	if err == nil {
+		err = bc.store.PutStateDiff(b.Height, diff)
+	}
+	if err != nil {
+		if rerr := bc.store.Rewind(b.Height - 1); rerr != nil {
+			return fmt.Errorf("%w (removing block (%d) failed: %s)", err, b.Height, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkpointState stores the state of the block that left the blocks kept
+// in memory when the one at the given height was added, every
+// checkpointInterval blocks. Such a block can no longer be reorganized
+// away. A pruned node only needs the last checkpoint to restart from, the
+// ones before it are removed.
+func (bc *BlockChain) checkpointState(tip uint32) error {
+	if tip <= bc.stateHistory+1 {
+		return nil
+	}
+	height := tip - bc.stateHistory - 1
+	if height%bc.checkpointInterval != 0 {
+		return nil
+	}
+	bc.lock.RLock()
+	view := bc.versions[height]
+	bc.lock.RUnlock()
+	if err := bc.store.PutStateCheckpoint(height, view.entries()); err != nil {
+		return err
+	}
+	if bc.archive {
+		return nil
+	}
+	return bc.store.PruneStateCheckpoints(height)
+}
+
+// commitBlockState commits the state of an executed block and publishes a
+// view of it. The view is kept in memory for as long as the block can
+// still be reorganized away or is among the last stateHistory blocks.
+func (bc *BlockChain) commitBlockState(b *Block, s *State) {
+	s.Commit()
+	view := &StateView{State: bc.contractState.View(), Header: b.Header}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.versions[b.Height] = view
+	if b.Height > bc.stateHistory+1 {
+		delete(bc.versions, b.Height-bc.stateHistory-2)
+	}
+	bc.head = view
+}
+
+// revertBlockState rolls the chain state back to before the block at the
+// given height was applied and publishes the view of it.
+func (bc *BlockChain) revertBlockState(height uint32) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	parent := bc.versions[height-1]
+	bc.contractState.trie, bc.contractState.storage = parent.trie, parent.storage
+	delete(bc.versions, height)
+	bc.head = parent
+}
+
+// replayState rebuilds the chain state of a reopened chain. It starts from
+// the last checkpoint below the blocks whose state is kept in memory and
+// executes the blocks above it. Receipts, state diffs and checkpoints that
+// did not make it to the store before the node stopped are written again.
+func (bc *BlockChain) replayState(to uint32) error {
+	if _, err := bc.store.GetReceipts(0); err != nil {
+		if err := bc.store.PutReceipts(0, nil); err != nil {
+			return err
+		}
+	}
+	if _, err := bc.store.GetStateDiff(0); err != nil {
+		genesis, err := bc.store.Get(0)
+		if err != nil {
+			return err
+		}
+		if err := bc.store.PutStateDiff(0, genesisDiff(genesis, bc.contractState)); err != nil {
+			return err
+		}
+	}
+	last, err := bc.store.StateCheckpointBelow(to)
+	if err != nil {
+		if err := bc.store.PutStateCheckpoint(0, bc.contractState.entries()); err != nil {
+			return err
+		}
+	}
+	from := uint32(0)
+	if to > bc.stateHistory+1 {
+		from, _ = bc.store.StateCheckpointBelow(to - bc.stateHistory - 1)
+	}
+	if from > 0 {
+		b, err := bc.store.Get(from)
+		if err != nil {
+			return err
+		}
+		checkpoint, err := bc.loadCheckpoint(b.Header)
+		if err != nil {
+			return err
+		}
+		bc.contractState.trie, bc.contractState.storage = checkpoint.trie, checkpoint.storage
+		bc.lock.Lock()
+		bc.head = &StateView{State: bc.contractState.View(), Header: b.Header}
+		bc.versions = map[uint32]*StateView{from: bc.head}
+		bc.lock.Unlock()
+	}
+	if to == from {
+		return nil
+	}
+	return bc.store.Range(from+1, to, func(b *Block) error {
+		blockState, receipts, diff, err := bc.executeBlock(b)
+		if err != nil {
+			return err
+		}
+		if _, err := bc.store.GetReceipts(b.Height); err != nil {
+			if err := bc.store.PutReceipts(b.Height, receipts); err != nil {
+				return err
+			}
+		}
+		if _, err := bc.store.GetStateDiff(b.Height); err != nil {
+			if err := bc.store.PutStateDiff(b.Height, diff); err != nil {
+				return err
+			}
+		}
+		bc.commitBlockState(b, blockState)
+		if b.Height > last+bc.stateHistory+1 {
+			return bc.checkpointState(b.Height)
+		}
+		return nil
+	})
+}
+
+// loadCheckpoint reads the checkpoint of the block with the given header
+// from the store and checks it against the state root of the header.
+func (bc *BlockChain) loadCheckpoint(header *Header) (*State, error) {
+	entries, err := bc.store.GetStateCheckpoint(header.Height)
+	if err != nil {
+		return nil, err
+	}
+	s := NewState()
+	for key, value := range entries {
+		if err := s.Put([]byte(key), value); err != nil {
+			return nil, err
+		}
+	}
+	if s.Root() != header.StateRoot {
+		return nil, fmt.Errorf("%w: state checkpoint of block (%d) does not match its state root", ErrStoreCorrupted, header.Height)
+	}
+	return s.View(), nil
+}
+
+// ProposeBlock builds and signs the block on top of the tip with the given
+// transactions. Transactions that cannot be included, because they
+// expired, because of their nonce, the funds of their sender or the limits
+// of the block, are left out. The fees and the block
+// reward are credited to the address of the key. The block is executed
+// without touching the chain to fill in the roots of its header, it still
+// has to be added with AddBlock.
+func (bc *BlockChain) ProposeBlock(priv crypto.PrivateKey, txs []*Transaction) (*Block, error) {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
+	tip, err := bc.GetHeader(bc.Height())
+	if err != nil {
+		return nil, err
+	}
+	// the transactions run against a draft of the header, the block is only
+	// made once its header can be filled in completely
+	draft := &Header{
+		Height:    tip.Height + 1,
+		Proposer:  priv.PublicKey().Address(),
+		Timestamp: nextTimestamp(bc.now(), tip),
+	}
+	params := bc.consensus()
+	blockState := bc.contractState.Child()
+	included := []*Transaction{}
+	receipts := []*Receipt{}
+	size, cost := 0, uint64(0)
+	for _, tx := range txs {
+		if params.MaxBlockTxs > 0 && len(included) == int(params.MaxBlockTxs) {
+			break
+		}
+		if tx.Expired(draft.Height, draft.Timestamp) {
+			continue
+		}
+		// a smaller transaction may still fit
+		txSize := encodedTxSize(tx)
+		if params.MaxBlockBytes > 0 && size+txSize > int(params.MaxBlockBytes) {
+			continue
+		}
+		snapshot := blockState.Snapshot()
+		receipt, err := bc.executeBlockTx(blockState, draft, len(included), tx)
+		if err == nil && params.MaxBlockCost > 0 && cost+receipt.Cost > params.MaxBlockCost {
+			err = fmt.Errorf("%w: tx (%s) costs %d, %d left", ErrBlockLimit, tx.Hash(TxHasher{}), receipt.Cost, params.MaxBlockCost-cost)
+		}
+		if err != nil {
+			bc.Logger.Log("msg", "leaving out transaction", "err", err)
+			if err := blockState.RevertToSnapshot(snapshot); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := blockState.DiscardSnapshot(snapshot); err != nil {
+			return nil, err
+		}
+		included = append(included, tx)
+		size += txSize
+		cost += receipt.Cost
+		receipts = append(receipts, receipt)
+	}
+	if err := bc.rewardProposer(blockState, draft); err != nil {
+		return nil, err
+	}
+	b, err := NewBlockFromHeader(tip, included, HeaderFields{
+		Proposer:     draft.Proposer,
+		Timestamp:    draft.Timestamp,
+		StateRoot:    blockState.Root(),
+		ReceiptsRoot: ReceiptsRoot(receipts),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Sign(priv); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
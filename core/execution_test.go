@@ -0,0 +1,143 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// storeCode returns code that stores the int value under key.
+func storeCode(key string, value byte) []byte {
+	code := []byte{}
+	for _, b := range []byte(key) {
+		code = append(code, b, byte(InstrPushByte))
+	}
+	code = append(code, byte(len(key)), byte(InstrPushInt), byte(InstrPack))
+	return append(code, value, byte(InstrPushInt), byte(InstrStore))
+}
+
+// blockWithCode proposes a block on top of the tip of the chain with a
+// transaction for each of the given codes.
+func blockWithCode(t *testing.T, bc *BlockChain, code ...[]byte) *Block {
+	txx := []*Transaction{}
+	for _, c := range code {
+		tx := NewTransaction(c)
+		tx.ChainID = bc.ChainID()
+		assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+		txx = append(txx, tx)
+	}
+	return proposeBlock(t, bc, txx...)
+}
+
+// mustAdd adds the block to the chain and returns it.
+func mustAdd(t *testing.T, bc *BlockChain, b *Block) *Block {
+	assert.Nil(t, bc.AddBlock(b))
+	return b
+}
+
+func assertStateValue(t *testing.T, s *State, key string, value int64) {
+	v, err := s.Get([]byte(key))
+	assert.Nil(t, err)
+	assert.Equal(t, value, deserializeInt64(v))
+}
+
+func TestExecuteBlock(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	b := mustAdd(t, bc, blockWithCode(t, bc, storeCode("foo", 1), storeCode("bar", 2)))
+	assertStateValue(t, bc.contractState, "foo", 1)
+	assertStateValue(t, bc.contractState, "bar", 2)
+
+	// every snapshot taken while executing is released again
+	blockState, _, _, err := bc.executeBlock(blockWithCode(t, bc, storeCode("baz", 3)))
+	assert.Nil(t, err)
+	assert.Empty(t, blockState.snapshots)
+	assert.Empty(t, blockState.journal)
+
+	// the proposed block was hashed only once its header was complete
+	assert.Equal(t, BlockHasher{}.Hash(b.Header), b.Hash(BlockHasher{}))
+	receipts, err := bc.GetReceipts(1)
+	assert.Nil(t, err)
+	for _, r := range receipts {
+		assert.Equal(t, b.Hash(BlockHasher{}), r.BlockHash)
+	}
+}
+
+func TestFailedTransactionDiscardsWrites(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+
+	// stores foo and then fails on an add with an empty stack
+	failing := append(storeCode("foo", 1), byte(InstrAdd))
+	b := blockWithCode(t, bc, failing, storeCode("bar", 2))
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Equal(t, uint32(1), bc.Height())
+
+	_, err := bc.contractState.Get([]byte("foo"))
+	assert.NotNil(t, err)
+	assertStateValue(t, bc.contractState, "bar", 2)
+}
+
+func TestReorgRevertsState(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	builder := newBuilder(t, bc)
+
+	a1 := blockWithCode(t, bc, storeCode("a", 1), storeCode("shared", 1))
+	assert.Nil(t, bc.AddBlock(a1))
+	assertStateValue(t, bc.contractState, "a", 1)
+
+	b1 := mustAdd(t, builder, blockWithCode(t, builder, storeCode("shared", 2)))
+	b2 := mustAdd(t, builder, blockWithCode(t, builder, storeCode("b", 2)))
+	assert.Nil(t, bc.AddBlock(b1))
+	assert.Nil(t, bc.AddBlock(b2))
+	tip, err := bc.GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, b2.Hash(BlockHasher{}), tip.Hash(BlockHasher{}))
+
+	_, err = bc.contractState.Get([]byte("a"))
+	assert.NotNil(t, err)
+	assertStateValue(t, bc.contractState, "shared", 2)
+	assertStateValue(t, bc.contractState, "b", 2)
+}
+
+func TestReplayStateOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, [32]byte{})
+	bc := newFileStoreChain(t, dir, genesis)
+	assert.Nil(t, bc.AddBlock(blockWithCode(t, bc, storeCode("foo", 1))))
+	assert.Nil(t, bc.AddBlock(blockWithCode(t, bc, storeCode("foo", 2), storeCode("bar", 3))))
+	assert.Nil(t, bc.Close())
+
+	bc = newFileStoreChain(t, dir, genesis)
+	defer bc.Close()
+	assertStateValue(t, bc.contractState, "foo", 2)
+	assertStateValue(t, bc.contractState, "bar", 3)
+}
+
+func TestBlockRootsMustMatchExecution(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	priv := crypto.GeneratePrivateKey()
+
+	b, err := bc.ProposeBlock(priv, nil)
+	assert.Nil(t, err)
+	// the root of an empty state is the zero hash
+	b.StateRoot = types.Hash{0x1}
+	b.hash = types.Hash{}
+	assert.Nil(t, b.Sign(priv))
+	assert.ErrorIs(t, bc.AddBlock(b), ErrStateRoot)
+
+	b, err = bc.ProposeBlock(priv, nil)
+	assert.Nil(t, err)
+	b.ReceiptsRoot = types.Hash{}
+	b.hash = types.Hash{}
+	assert.Nil(t, b.Sign(priv))
+	assert.ErrorIs(t, bc.AddBlock(b), ErrReceiptsRoot)
+
+	b, err = bc.ProposeBlock(priv, nil)
+	assert.Nil(t, err)
+	b.Proposer = crypto.GeneratePrivateKey().PublicKey().Address()
+	b.hash = types.Hash{}
+	assert.Nil(t, b.Sign(priv))
+	assert.NotNil(t, bc.AddBlock(b))
+	assert.Equal(t, uint32(0), bc.Height())
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"myblockchain/types"
+)
+
+const exportVersion uint16 = 2
+
+var exportMagic = [4]byte{'M', 'B', 'C', 'X'}
+
+// exportHeader starts every export file. The blocks follow as checksummed
+// records, the same framing the FileStore uses on disk.
+type exportHeader struct {
+	Magic       [4]byte
+	Version     uint16
+	GenesisHash types.Hash
+	From        uint32
+	To          uint32
+}
+
+// ImportProgress is reported after every block read from an export.
+type ImportProgress struct {
+	Height   uint32
+	From     uint32
+	To       uint32
+	Imported int
+	// Skipped counts the blocks that were already known, which is what
+	// makes rerunning a failed import resume where it stopped.
+	Skipped int
+}
+
+// ImportError tells at which block an import stopped.
+type ImportError struct {
+	Height uint32
+	Err    error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("import failed at block (%d): %s", e.Height, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// ExportChain writes the blocks from height from up to and including height
+// to into w. progress, if not nil, is called after every written block.
+func ExportChain(bc *BlockChain, w io.Writer, from, to uint32, progress func(height uint32)) error {
+	if from > to {
+		return fmt.Errorf("invalid export range (%d - %d)", from, to)
+	}
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		return err
+	}
+	header := exportHeader{
+		Magic:       exportMagic,
+		Version:     exportVersion,
+		GenesisHash: genesis.Hash(BlockHasher{}),
+		From:        from,
+		To:          to,
+	}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	return bc.RangeBlocks(from, to, func(b *Block) error {
+		buf := &bytes.Buffer{}
+		if err := b.Encode(NewBinaryBlockEncoder(buf)); err != nil {
+			return err
+		}
+		if err := writeExportRecord(w, buf.Bytes()); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(b.Height)
+		}
+		return nil
+	})
+}
+
+// ImportChain reads an export and adds its blocks to the chain with full
+// validation. Blocks the chain already has are skipped, so an import that
+// failed halfway can simply be run again.
+func ImportChain(bc *BlockChain, r io.Reader, progress func(ImportProgress)) (ImportProgress, error) {
+	header := exportHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return ImportProgress{}, fmt.Errorf("cannot read export header: %s", err)
+	}
+	if header.Magic != exportMagic {
+		return ImportProgress{}, fmt.Errorf("not a chain export")
+	}
+	if header.Version != exportVersion {
+		return ImportProgress{}, fmt.Errorf("unsupported export version (%d)", header.Version)
+	}
+	genesis, err := bc.GetBlock(0)
+	if err != nil {
+		return ImportProgress{}, err
+	}
+	if header.GenesisHash != genesis.Hash(BlockHasher{}) {
+		return ImportProgress{}, fmt.Errorf("export belongs to genesis (%s), chain has genesis (%s)", header.GenesisHash, genesis.Hash(BlockHasher{}))
+	}
+
+	p := ImportProgress{From: header.From, To: header.To}
+	for height := header.From; height <= header.To; height++ {
+		payload, err := readExportRecord(r)
+		if err != nil {
+			return p, &ImportError{Height: height, Err: err}
+		}
+		b := new(Block)
+		if err := b.Decode(NewBinaryBlockDecoder(bytes.NewReader(payload))); err != nil {
+			return p, &ImportError{Height: height, Err: err}
+		}
+		if b.Height != height {
+			return p, &ImportError{Height: height, Err: fmt.Errorf("export contains block (%d) out of order", b.Height)}
+		}
+		err = bc.AddBlock(b)
+		switch {
+		case errors.Is(err, ErrBlockKnown):
+			p.Skipped++
+		case err != nil:
+			return p, &ImportError{Height: height, Err: err}
+		default:
+			p.Imported++
+		}
+		p.Height = height
+		if progress != nil {
+			progress(p)
+		}
+		if height == header.To {
+			break
+		}
+	}
+	return p, nil
+}
+
+// Records are bounded by the size of the largest value of the codec, the
+// length of a record is checked before anything is allocated for it.
+func writeExportRecord(w io.Writer, payload []byte) error {
+	if len(payload) > maxCodecBytes {
+		return fmt.Errorf("record of (%d) bytes too large", len(payload))
+	}
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readExportRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size > maxCodecBytes {
+		return nil, fmt.Errorf("record of (%d) bytes too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header[4:8]) != crc32.ChecksumIEEE(payload) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return payload, nil
+}
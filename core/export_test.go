@@ -0,0 +1,97 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImportChain(t *testing.T) {
+	genesis := randBlock(t, 0, types.Hash{})
+	src, err := NewBlockChain(nil, genesis)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, src.AddBlock(nextBlock(t, src)))
+	}
+
+	buf := &bytes.Buffer{}
+	exported := []uint32{}
+	assert.Nil(t, ExportChain(src, buf, 0, 10, func(height uint32) {
+		exported = append(exported, height)
+	}))
+	assert.Len(t, exported, 11)
+
+	dst, err := NewBlockChain(nil, genesis)
+	assert.Nil(t, err)
+	calls := 0
+	p, err := ImportChain(dst, bytes.NewReader(buf.Bytes()), func(ImportProgress) { calls++ })
+	assert.Nil(t, err)
+	assert.Equal(t, 11, calls)
+	assert.Equal(t, 10, p.Imported)
+	// the genesis is already known
+	assert.Equal(t, 1, p.Skipped)
+	assert.Equal(t, src.Height(), dst.Height())
+
+	tip, err := src.GetBlock(10)
+	assert.Nil(t, err)
+	imported, err := dst.GetBlock(10)
+	assert.Nil(t, err)
+	assert.Equal(t, tip.Hash(BlockHasher{}), imported.Hash(BlockHasher{}))
+}
+
+func TestImportResume(t *testing.T) {
+	genesis := randBlock(t, 0, types.Hash{})
+	src, err := NewBlockChain(nil, genesis)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, src.AddBlock(nextBlock(t, src)))
+	}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ExportChain(src, buf, 1, 10, nil))
+
+	dst, err := NewBlockChain(nil, genesis)
+	assert.Nil(t, err)
+	// the file got cut off somewhere after the 5th block
+	half := buf.Bytes()[:buf.Len()/2+10]
+	p, err := ImportChain(dst, bytes.NewReader(half), nil)
+	importErr := new(ImportError)
+	assert.ErrorAs(t, err, &importErr)
+	assert.Equal(t, uint32(p.Imported+1), importErr.Height)
+	assert.Equal(t, uint32(p.Imported), dst.Height())
+
+	p, err = ImportChain(dst, bytes.NewReader(buf.Bytes()), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(10), dst.Height())
+	assert.Equal(t, 10, p.Imported+p.Skipped)
+	assert.NotZero(t, p.Skipped)
+}
+
+func TestImportWrongGenesis(t *testing.T) {
+	src := NewBlockChainWithGenesis(t)
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ExportChain(src, buf, 0, 0, nil))
+
+	dst := NewBlockChainWithGenesis(t)
+	_, err := ImportChain(dst, buf, nil)
+	assert.NotNil(t, err)
+
+	_, err = ImportChain(dst, bytes.NewReader([]byte("foo bar baz")), nil)
+	assert.NotNil(t, err)
+}
+
+func TestImportRejectsOversizedRecord(t *testing.T) {
+	src := NewBlockChainWithGenesis(t)
+	buf := &bytes.Buffer{}
+	assert.Nil(t, ExportChain(src, buf, 0, 0, nil))
+
+	// a record claiming 4 GiB must not be allocated
+	export := buf.Bytes()[:binary.Size(exportHeader{})]
+	export = append(export, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00)
+	_, err := ImportChain(src, bytes.NewReader(export), nil)
+	importErr := new(ImportError)
+	assert.ErrorAs(t, err, &importErr)
+	assert.ErrorContains(t, err, "too large")
+}
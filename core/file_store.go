@@ -0,0 +1,643 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"myblockchain/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var ErrStoreCorrupted = errors.New("store corrupted")
+
+const (
+	// record header in the data file: payload size (4) + crc32 of the payload (4)
+	recordHeaderSize = 8
+	// index entry: offset of the record in the data file (8) + payload size (4)
+	indexEntrySize = 12
+)
+
+// recordLog is an append-only log of checksummed records. Every record is
+// addressed by its position in the log, which is kept in a fixed size index
+// file next to the data file.
+type recordLog struct {
+	data  *os.File
+	index *os.File
+	// size of the valid part of the data file
+	size  int64
+	count uint32
+}
+
+// openRecordLog opens the log and checks every record, visit is called
+// with each record that passes, in order.
+func openRecordLog(dataPath, indexPath string, visit func(payload []byte) error) (*recordLog, error) {
+	data, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	l := &recordLog{data: data, index: index}
+	if err := l.recover(visit); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// recover checks every record against its index entry and checksum. A torn
+// write at the tail of either file (a crash in the middle of an append) is
+// cut off, anything else that does not add up is reported as corruption.
+func (l *recordLog) recover(visit func(payload []byte) error) error {
+	dataInfo, err := l.data.Stat()
+	if err != nil {
+		return err
+	}
+	indexInfo, err := l.index.Stat()
+	if err != nil {
+		return err
+	}
+	var (
+		dataSize = dataInfo.Size()
+		entries  = uint32(indexInfo.Size() / indexEntrySize)
+		end      = int64(0)
+		n        = uint32(0)
+	)
+	for ; n < entries; n++ {
+		offset, size, err := l.entry(n)
+		if err != nil {
+			return err
+		}
+		if offset != end {
+			return fmt.Errorf("%w: record %d starts at %d, expected %d", ErrStoreCorrupted, n, offset, end)
+		}
+		if offset+recordHeaderSize+int64(size) > dataSize {
+			// the record was never completely written
+			break
+		}
+		payload, err := l.read(n)
+		if err != nil {
+			return err
+		}
+		if visit != nil {
+			if err := visit(payload); err != nil {
+				return err
+			}
+		}
+		end = offset + recordHeaderSize + int64(size)
+	}
+	if err := l.index.Truncate(int64(n) * indexEntrySize); err != nil {
+		return err
+	}
+	if err := l.data.Truncate(end); err != nil {
+		return err
+	}
+	l.size = end
+	l.count = n
+	return nil
+}
+
+func (l *recordLog) entry(n uint32) (int64, uint32, error) {
+	buf := make([]byte, indexEntrySize)
+	if _, err := l.index.ReadAt(buf, int64(n)*indexEntrySize); err != nil {
+		return 0, 0, err
+	}
+	return int64(binary.BigEndian.Uint64(buf[:8])), binary.BigEndian.Uint32(buf[8:]), nil
+}
+
+func (l *recordLog) read(n uint32) ([]byte, error) {
+	offset, size, err := l.entry(n)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, recordHeaderSize+int(size))
+	if _, err := l.data.ReadAt(buf, offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: record %d is truncated", ErrStoreCorrupted, n)
+		}
+		return nil, err
+	}
+	payload := buf[recordHeaderSize:]
+	if binary.BigEndian.Uint32(buf[:4]) != size {
+		return nil, fmt.Errorf("%w: record %d size mismatch", ErrStoreCorrupted, n)
+	}
+	if binary.BigEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(payload) {
+		return nil, fmt.Errorf("%w: record %d checksum mismatch", ErrStoreCorrupted, n)
+	}
+	return payload, nil
+}
+
+// append writes the record and syncs it to disk before the index entry
+// pointing to it is written, so the index never references missing data.
+func (l *recordLog) append(payload []byte) error {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[recordHeaderSize:], payload)
+	if _, err := l.data.WriteAt(buf, l.size); err != nil {
+		return err
+	}
+	if err := l.data.Sync(); err != nil {
+		return err
+	}
+
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry[:8], uint64(l.size))
+	binary.BigEndian.PutUint32(entry[8:], uint32(len(payload)))
+	if _, err := l.index.WriteAt(entry, int64(l.count)*indexEntrySize); err != nil {
+		return err
+	}
+	if err := l.index.Sync(); err != nil {
+		return err
+	}
+	l.size += int64(len(buf))
+	l.count++
+	return nil
+}
+
+// truncate keeps the first n records of the log.
+func (l *recordLog) truncate(n uint32) error {
+	if n >= l.count {
+		return nil
+	}
+	offset, _, err := l.entry(n)
+	if err != nil {
+		return err
+	}
+	// the index goes first, a record without an index entry is cut off on
+	// the next open anyway.
+	if err := l.index.Truncate(int64(n) * indexEntrySize); err != nil {
+		return err
+	}
+	if err := l.index.Sync(); err != nil {
+		return err
+	}
+	if err := l.data.Truncate(offset); err != nil {
+		return err
+	}
+	l.size = offset
+	l.count = n
+	return l.data.Sync()
+}
+
+func (l *recordLog) Close() error {
+	err := l.data.Close()
+	if ierr := l.index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// FileStore persists blocks in an append-only log inside a directory. The
+// n-th record of the log is the block at height n, the n-th records of the
+// receipts and diffs logs hold the receipts and the state diff of that
+// block. State checkpoints are kept in a file each, so the ones that are
+// no longer needed can be removed. Opening the store reads the block log
+// once: every block is checked against its checksum, has to claim its
+// height and link to the block below it, and the indexes of block and
+// transaction hashes are built from it. Blocks are never held in memory,
+// but the indexes are: they take about 50 bytes for every block and every
+// transaction, so their memory grows with the chain.
+type FileStore struct {
+	lock     sync.RWMutex
+	dir      string
+	blocks   *recordLog
+	receipts *recordLog
+	diffs    *recordLog
+	hashes   map[types.Hash]uint32
+	txs      map[types.Hash]txPosition
+
+	// heights of the state checkpoints, in increasing order
+	checkpointHeights []uint32
+}
+
+type txPosition struct {
+	height uint32
+	index  uint32
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		dir:    dir,
+		hashes: make(map[types.Hash]uint32),
+		txs:    make(map[types.Hash]txPosition),
+	}
+	var (
+		err error
+		// hash of the last block checked
+		prev types.Hash
+	)
+	s.blocks, err = openRecordLog(filepath.Join(dir, "blocks.dat"), filepath.Join(dir, "blocks.idx"), func(payload []byte) error {
+		b, err := s.indexBlock(payload, prev)
+		if err != nil {
+			return err
+		}
+		prev = b.Hash(BlockHasher{})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.receipts, err = openRecordLog(filepath.Join(dir, "receipts.dat"), filepath.Join(dir, "receipts.idx"), nil)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// receipts are written after their block, any left over from a block
+	// that was cut off are dropped.
+	if err := s.receipts.truncate(s.blocks.count); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.diffs, err = openRecordLog(filepath.Join(dir, "diffs.dat"), filepath.Join(dir, "diffs.idx"), nil)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	// and so are state diffs after their receipts
+	if err := s.diffs.truncate(s.receipts.count); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.loadCheckpoints(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// loadCheckpoints finds the checkpoints in the checkpoints directory.
+// Checkpoints are written after the state diff of their block, those above
+// the last diff are removed, and so are files left over from a checkpoint
+// that was cut off.
+func (s *FileStore) loadCheckpoints() error {
+	dir := filepath.Join(s.dir, "checkpoints")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		var height uint32
+		_, err := fmt.Sscanf(f.Name(), checkpointFileFormat, &height)
+		if err != nil || f.Name() != fmt.Sprintf(checkpointFileFormat, height) || height >= s.diffs.count {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		s.checkpointHeights = append(s.checkpointHeights, height)
+	}
+	sort.Slice(s.checkpointHeights, func(i, j int) bool { return s.checkpointHeights[i] < s.checkpointHeights[j] })
+	return nil
+}
+
+// indexBlock decodes a block read from the log on open and adds it to the
+// indexes. It has to claim the next height and link to the block with the
+// given hash, the genesis block aside.
+func (s *FileStore) indexBlock(payload []byte, prev types.Hash) (*Block, error) {
+	height := uint32(len(s.hashes))
+	b := new(Block)
+	if err := b.Decode(NewBinaryBlockDecoder(bytes.NewReader(payload))); err != nil {
+		return nil, fmt.Errorf("%w: block (%d) cannot be decoded: %s", ErrStoreCorrupted, height, err)
+	}
+	if b.Height != height {
+		return nil, fmt.Errorf("%w: block at height (%d) claims height (%d)", ErrStoreCorrupted, height, b.Height)
+	}
+	if height > 0 && b.PrevBlockHash != prev {
+		return nil, fmt.Errorf("%w: block (%d) does not link to its parent", ErrStoreCorrupted, height)
+	}
+	s.addToIndexes(b)
+	return b, nil
+}
+
+// checksLinks marks the store as checking the links of its blocks on open.
+func (s *FileStore) checksLinks() {}
+
+func (s *FileStore) addToIndexes(b *Block) {
+	s.hashes[b.Hash(BlockHasher{})] = b.Height
+	for i, tx := range b.Transactions {
+		s.txs[tx.Hash(TxHasher{})] = txPosition{height: b.Height, index: uint32(i)}
+	}
+}
+
+func (s *FileStore) Put(b *Block) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if b.Height != s.blocks.count {
+		return fmt.Errorf("cannot store block (%d), next height in store is (%d)", b.Height, s.blocks.count)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Encode(NewBinaryBlockEncoder(buf)); err != nil {
+		return err
+	}
+	if err := s.blocks.append(buf.Bytes()); err != nil {
+		return err
+	}
+	s.addToIndexes(b)
+	return nil
+}
+
+func (s *FileStore) Get(height uint32) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.get(height)
+}
+
+func (s *FileStore) get(height uint32) (*Block, error) {
+	if height >= s.blocks.count {
+		return nil, fmt.Errorf("block at height (%d) not found", height)
+	}
+	payload, err := s.blocks.read(height)
+	if err != nil {
+		return nil, err
+	}
+	b := new(Block)
+	if err := b.Decode(NewBinaryBlockDecoder(bytes.NewReader(payload))); err != nil {
+		return nil, fmt.Errorf("%w: block (%d) cannot be decoded: %s", ErrStoreCorrupted, height, err)
+	}
+	return b, nil
+}
+
+func (s *FileStore) GetByHash(hash types.Hash) (*Block, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	height, ok := s.hashes[hash]
+	if !ok {
+		return nil, fmt.Errorf("block with hash (%s) not found", hash)
+	}
+	return s.get(height)
+}
+
+func (s *FileStore) GetTx(hash types.Hash) (*Transaction, *TxLocation, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	pos, ok := s.txs[hash]
+	if !ok {
+		return nil, nil, fmt.Errorf("could not find tx with hash (%s)", hash)
+	}
+	b, err := s.get(pos.height)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int(pos.index) >= len(b.Transactions) {
+		return nil, nil, fmt.Errorf("%w: tx (%s) points outside of block (%d)", ErrStoreCorrupted, hash, pos.height)
+	}
+	loc := &TxLocation{
+		BlockHash: b.Hash(BlockHasher{}),
+		Height:    pos.height,
+		Index:     pos.index,
+	}
+	return b.Transactions[pos.index], loc, nil
+}
+
+func (s *FileStore) Range(from, to uint32, fn func(*Block) error) error {
+	for height := from; height <= to; height++ {
+		b, err := s.Get(height)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiptsRecord wraps the receipts of a block, gob cannot encode a nil
+// slice on its own.
+type receiptsRecord struct {
+	Receipts []*Receipt
+}
+
+func (s *FileStore) PutReceipts(height uint32, receipts []*Receipt) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if height != s.receipts.count || height >= s.blocks.count {
+		return fmt.Errorf("cannot store receipts of block (%d)", height)
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(receiptsRecord{Receipts: receipts}); err != nil {
+		return err
+	}
+	return s.receipts.append(buf.Bytes())
+}
+
+func (s *FileStore) GetReceipts(height uint32) ([]*Receipt, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if height >= s.receipts.count {
+		return nil, fmt.Errorf("receipts of block (%d) not found", height)
+	}
+	payload, err := s.receipts.read(height)
+	if err != nil {
+		return nil, err
+	}
+	record := receiptsRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+		return nil, fmt.Errorf("%w: receipts of block (%d) cannot be decoded: %s", ErrStoreCorrupted, height, err)
+	}
+	return record.Receipts, nil
+}
+
+func (s *FileStore) PutStateDiff(height uint32, diff *StateDiff) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if height != s.diffs.count || height >= s.receipts.count {
+		return fmt.Errorf("cannot store state diff of block (%d)", height)
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(diff); err != nil {
+		return err
+	}
+	return s.diffs.append(buf.Bytes())
+}
+
+func (s *FileStore) GetStateDiff(height uint32) (*StateDiff, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if height >= s.diffs.count {
+		return nil, fmt.Errorf("state diff of block (%d) not found", height)
+	}
+	payload, err := s.diffs.read(height)
+	if err != nil {
+		return nil, err
+	}
+	diff := &StateDiff{}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(diff); err != nil {
+		return nil, fmt.Errorf("%w: state diff of block (%d) cannot be decoded: %s", ErrStoreCorrupted, height, err)
+	}
+	return diff, nil
+}
+
+// checkpointFileFormat names the file of the checkpoint of a height.
+const checkpointFileFormat = "%010d.ckpt"
+
+func (s *FileStore) checkpointPath(height uint32) string {
+	return filepath.Join(s.dir, "checkpoints", fmt.Sprintf(checkpointFileFormat, height))
+}
+
+// PutStateCheckpoint writes the checkpoint to a temporary file, which is
+// only renamed to its place once it is synced, so a checkpoint file is
+// always complete.
+func (s *FileStore) PutStateCheckpoint(height uint32, entries map[string][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	last := len(s.checkpointHeights) - 1
+	if height >= s.diffs.count || (last >= 0 && height <= s.checkpointHeights[last]) {
+		return fmt.Errorf("cannot store state checkpoint of block (%d)", height)
+	}
+	buf := bytes.NewBuffer(make([]byte, 4))
+	if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+		return err
+	}
+	record := buf.Bytes()
+	binary.BigEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+
+	path := s.checkpointPath(height)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(record); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.checkpointHeights = append(s.checkpointHeights, height)
+	return nil
+}
+
+func (s *FileStore) GetStateCheckpoint(height uint32) (map[string][]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	n := sort.Search(len(s.checkpointHeights), func(i int) bool { return s.checkpointHeights[i] >= height })
+	if n == len(s.checkpointHeights) || s.checkpointHeights[n] != height {
+		return nil, fmt.Errorf("state checkpoint of block (%d) not found", height)
+	}
+	record, err := os.ReadFile(s.checkpointPath(height))
+	if err != nil {
+		return nil, err
+	}
+	if len(record) < 4 || binary.BigEndian.Uint32(record[:4]) != crc32.ChecksumIEEE(record[4:]) {
+		return nil, fmt.Errorf("%w: state checkpoint of block (%d) checksum mismatch", ErrStoreCorrupted, height)
+	}
+	entries := make(map[string][]byte)
+	if err := gob.NewDecoder(bytes.NewReader(record[4:])).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("%w: state checkpoint of block (%d) cannot be decoded: %s", ErrStoreCorrupted, height, err)
+	}
+	return entries, nil
+}
+
+// PruneStateCheckpoints removes the checkpoints below the given height.
+func (s *FileStore) PruneStateCheckpoints(height uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := sort.Search(len(s.checkpointHeights), func(i int) bool { return s.checkpointHeights[i] >= height })
+	return s.removeCheckpoints(0, n)
+}
+
+// removeCheckpoints removes the checkpoints from the n-th up to the m-th.
+func (s *FileStore) removeCheckpoints(n, m int) error {
+	for i := n; i < m; i++ {
+		if err := os.Remove(s.checkpointPath(s.checkpointHeights[i])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s.checkpointHeights = append(s.checkpointHeights[:n], s.checkpointHeights[m:]...)
+	return nil
+}
+
+func (s *FileStore) StateCheckpointBelow(height uint32) (uint32, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	n := sort.Search(len(s.checkpointHeights), func(i int) bool { return s.checkpointHeights[i] > height })
+	if n == 0 {
+		return 0, fmt.Errorf("no state checkpoint at or below height (%d)", height)
+	}
+	return s.checkpointHeights[n-1], nil
+}
+
+func (s *FileStore) Rewind(height uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if height >= s.blocks.count {
+		return fmt.Errorf("cannot rewind to height (%d), store height is (%d)", height, int64(s.blocks.count)-1)
+	}
+	removed := make([]*Block, 0, s.blocks.count-height-1)
+	for h := height + 1; h < s.blocks.count; h++ {
+		b, err := s.get(h)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, b)
+	}
+	n := sort.Search(len(s.checkpointHeights), func(i int) bool { return s.checkpointHeights[i] > height })
+	if err := s.removeCheckpoints(n, len(s.checkpointHeights)); err != nil {
+		return err
+	}
+	if err := s.diffs.truncate(height + 1); err != nil {
+		return err
+	}
+	if err := s.receipts.truncate(height + 1); err != nil {
+		return err
+	}
+	if err := s.blocks.truncate(height + 1); err != nil {
+		return err
+	}
+
+	for _, b := range removed {
+		delete(s.hashes, b.Hash(BlockHasher{}))
+		for _, tx := range b.Transactions {
+			if s.txs[tx.Hash(TxHasher{})].height == b.Height {
+				delete(s.txs, tx.Hash(TxHasher{}))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Len() uint32 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.blocks.count
+}
+
+func (s *FileStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.blocks.Close()
+	for _, l := range []*recordLog{s.receipts, s.diffs} {
+		if l == nil {
+			continue
+		}
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
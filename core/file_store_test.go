@@ -0,0 +1,254 @@
+package core
+
+import (
+	"myblockchain/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFileStoreChain(t *testing.T, dir string, genesis *Block) *BlockChain {
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{
+		Logger: log.NewNopLogger(),
+		Store:  store,
+	}, genesis)
+	assert.Nil(t, err)
+	return bc
+}
+
+func TestFileStorePutGet(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	genesis := randBlock(t, 0, types.Hash{})
+	assert.Nil(t, store.Put(genesis))
+	assert.NotNil(t, store.Put(randBlock(t, 5, types.Hash{})))
+	assert.Equal(t, uint32(1), store.Len())
+
+	b, err := store.Get(0)
+	assert.Nil(t, err)
+	assert.Equal(t, genesis.Hash(BlockHasher{}), b.Hash(BlockHasher{}))
+	assert.Equal(t, genesis.Transactions[0].Data, b.Transactions[0].Data)
+
+	_, err = store.Get(1)
+	assert.NotNil(t, err)
+}
+
+func TestFileStoreLookups(t *testing.T) {
+	dir := t.TempDir()
+	bc := newFileStoreChain(t, dir, randBlock(t, 0, types.Hash{}))
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	}
+	assert.Nil(t, bc.Close())
+
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	b3, err := store.Get(3)
+	assert.Nil(t, err)
+	b, err := store.GetByHash(b3.Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), b.Height)
+
+	// every random tx carries the same data, the latest inclusion wins
+	tip, err := store.Get(5)
+	assert.Nil(t, err)
+	tx := tip.Transactions[0]
+	fetched, loc, err := store.GetTx(tx.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, tx.Data, fetched.Data)
+	assert.Equal(t, tip.Hash(BlockHasher{}), loc.BlockHash)
+	assert.Equal(t, uint32(0), loc.Index)
+
+	heights := []uint32{}
+	assert.Nil(t, store.Range(2, 4, func(b *Block) error {
+		heights = append(heights, b.Height)
+		return nil
+	}))
+	assert.Equal(t, []uint32{2, 3, 4}, heights)
+	assert.NotNil(t, store.Range(4, 6, func(*Block) error { return nil }))
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, types.Hash{})
+	bc := newFileStoreChain(t, dir, genesis)
+	for i := 0; i < 10; i++ {
+		b := nextBlock(t, bc)
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	tip, err := bc.GetBlock(10)
+	assert.Nil(t, err)
+	assert.Nil(t, bc.Close())
+
+	bc = newFileStoreChain(t, dir, genesis)
+	defer bc.Close()
+	assert.Equal(t, uint32(10), bc.Height())
+	b, err := bc.GetBlockByHash(tip.Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, tip.Height, b.Height)
+	tx, err := bc.GetTxByHash(tip.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, tip.Transactions[0].Data, tx.Data)
+
+	// the chain keeps growing on top of the reopened store
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+}
+
+func TestFileStoreGenesisMismatch(t *testing.T) {
+	dir := t.TempDir()
+	bc := newFileStoreChain(t, dir, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, bc.Close())
+
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	_, err = NewBlockChainWithOptions(BlockChainOptions{Store: store}, randBlock(t, 0, types.Hash{}))
+	assert.NotNil(t, err)
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	bc := newFileStoreChain(t, dir, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	assert.Nil(t, bc.Close())
+
+	// simulate a crash in the middle of appending the next record
+	f, err := os.OpenFile(filepath.Join(dir, "blocks.dat"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0x00, 0x00, 0x01, 0x00, 0xde, 0xad})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	f, err = os.OpenFile(filepath.Join(dir, "blocks.idx"), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{0x00, 0x01})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Equal(t, uint32(2), store.Len())
+	_, err = store.Get(1)
+	assert.Nil(t, err)
+}
+
+func TestFileStoreCorruption(t *testing.T) {
+	dir := t.TempDir()
+	bc := newFileStoreChain(t, dir, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	assert.Nil(t, bc.Close())
+
+	path := filepath.Join(dir, "blocks.dat")
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[recordHeaderSize+10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+
+	_, err = NewFileStore(dir)
+	assert.ErrorIs(t, err, ErrStoreCorrupted)
+}
+
+func TestFileStoreCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	opts := BlockChainOptions{Store: store, MaxForkDepth: 1, StateHistory: 1, Archive: true, CheckpointInterval: 3}
+	bc, err := NewBlockChainWithOptions(opts, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, err)
+	for i := 0; i < 9; i++ {
+		assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	}
+	assert.Nil(t, bc.Close())
+
+	store, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	height, err := store.StateCheckpointBelow(5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), height)
+	_, err = store.GetStateCheckpoint(4)
+	assert.NotNil(t, err)
+	entries, err := store.GetStateCheckpoint(6)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, entries)
+	// checkpoints only go up
+	assert.NotNil(t, store.PutStateCheckpoint(6, entries))
+
+	assert.Nil(t, store.Rewind(5))
+	assert.Nil(t, store.PruneStateCheckpoints(3))
+	assert.Nil(t, store.Close())
+	// a checkpoint cut off while it was written is not picked up
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "checkpoints", "0000000005.ckpt.tmp"), []byte("torn"), 0644))
+
+	store, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+	height, err = store.StateCheckpointBelow(7)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), height)
+	_, err = store.StateCheckpointBelow(2)
+	assert.NotNil(t, err)
+	files, err := os.ReadDir(filepath.Join(dir, "checkpoints"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestFileStoreChecksLinksOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put(randBlock(t, 0, types.Hash{})))
+	assert.Nil(t, store.Put(randBlock(t, 1, types.Hash{0x1})))
+	assert.Nil(t, store.Close())
+
+	_, err = NewFileStore(dir)
+	assert.ErrorIs(t, err, ErrStoreCorrupted)
+}
+
+// rangeCountingStore counts the blocks read through Range.
+type rangeCountingStore struct {
+	*FileStore
+	ranged int
+}
+
+func (s *rangeCountingStore) Range(from, to uint32, fn func(*Block) error) error {
+	return s.FileStore.Range(from, to, func(b *Block) error {
+		s.ranged++
+		return fn(b)
+	})
+}
+
+func TestFileStoreReopenReadsTheChainOnce(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, types.Hash{})
+	opts := BlockChainOptions{MaxForkDepth: 2, StateHistory: 2, CheckpointInterval: 4}
+	store, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	opts.Store = store
+	bc, err := NewBlockChainWithOptions(opts, genesis)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	}
+	assert.Nil(t, bc.Close())
+
+	// opening the store checked every block, the chain only replays the
+	// blocks above the last checkpoint
+	store, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	counting := &rangeCountingStore{FileStore: store}
+	opts.Store = counting
+	bc, err = NewBlockChainWithOptions(opts, genesis)
+	assert.Nil(t, err)
+	defer bc.Close()
+	assert.Equal(t, uint32(20), bc.Height())
+	assert.LessOrEqual(t, counting.ranged, 4)
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"myblockchain/types"
+)
+
+const defaultMaxForkDepth = 64
+
+// ForkChoice decides which branch of the block tree is the canonical chain.
+type ForkChoice interface {
+	// Prefer reports whether the branch ending in candidate should replace
+	// the canonical branch ending in current.
+	Prefer(current, candidate *Header) bool
+}
+
+// LongestChain prefers the branch with the highest tip.
+type LongestChain struct {
+	// PreferLowerHash breaks ties between tips of the same height by picking
+	// the lower block hash instead of keeping the first one seen, so every
+	// node converges on the same branch without waiting for the next block.
+	PreferLowerHash bool
+}
+
+func (lc LongestChain) Prefer(current, candidate *Header) bool {
+	if candidate.Height != current.Height {
+		return candidate.Height > current.Height
+	}
+	if !lc.PreferLowerHash {
+		return false
+	}
+	a, b := BlockHasher{}.Hash(candidate), BlockHasher{}.Hash(current)
+	return bytes.Compare(a[:], b[:]) < 0
+}
+
+// Reorg describes a switch of the canonical chain to another branch.
+type Reorg struct {
+	Ancestor  *Header
+	OldBranch []*Block
+	NewBranch []*Block
+	// Dropped holds the transactions of the old branch that did not make it
+	// into the new one.
+	Dropped []*Transaction
+}
+
+// addSideBlock keeps a block that does not extend the canonical tip in the
+// tree of side branches.
+func (bc *BlockChain) addSideBlock(b *Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.sideBlocks[b.Hash(BlockHasher{})] = b
+	bc.forks[b.PrevBlockHash] = append(bc.forks[b.PrevBlockHash], b)
+}
+
+func (bc *BlockChain) removeSideBlock(b *Block) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.removeSideBlockLocked(b)
+}
+
+func (bc *BlockChain) removeSideBlockLocked(b *Block) {
+	hash := b.Hash(BlockHasher{})
+	delete(bc.sideBlocks, hash)
+	siblings := bc.forks[b.PrevBlockHash]
+	for i, sibling := range siblings {
+		if sibling.Hash(BlockHasher{}) == hash {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(bc.forks, b.PrevBlockHash)
+	} else {
+		bc.forks[b.PrevBlockHash] = siblings
+	}
+}
+
+// pruneSideBlocks drops side branches that are too deep below the tip to
+// ever become canonical.
+func (bc *BlockChain) pruneSideBlocks() {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	if bc.height < bc.maxForkDepth {
+		return
+	}
+	for _, b := range bc.sideBlocks {
+		if b.Height < bc.height-bc.maxForkDepth {
+			bc.removeSideBlockLocked(b)
+		}
+	}
+}
+
+// sideBranch walks back from the given side block until it reaches the
+// canonical chain and returns the branch in ascending order.
+func (bc *BlockChain) sideBranch(tip *Block) []*Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	branch := []*Block{tip}
+	for {
+		parent, ok := bc.sideBlocks[branch[0].PrevBlockHash]
+		if !ok {
+			break
+		}
+		branch = append([]*Block{parent}, branch...)
+	}
+	return branch
+}
+
+// reorg makes the branch ending in the given side block the canonical chain.
+// The state is rolled back to the common ancestor and the new branch is
+// executed on top of it. If a block of the new branch fails, the old branch
+// is restored and the failing block is dropped together with its children.
+func (bc *BlockChain) reorg(tip *Block) (*Reorg, error) {
+	newBranch := bc.sideBranch(tip)
+	ancestor, err := bc.store.GetByHash(newBranch[0].PrevBlockHash)
+	if err != nil {
+		return nil, fmt.Errorf("side branch of block (%s) is not connected to the chain: %s", tip.Hash(BlockHasher{}), err)
+	}
+
+	bc.lock.RLock()
+	_, ok := bc.versions[ancestor.Height]
+	bc.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot revert the state to block (%d)", ancestor.Height)
+	}
+	oldBranch := []*Block{}
+	if err := bc.store.Range(ancestor.Height+1, bc.Height(), func(b *Block) error {
+		oldBranch = append(oldBranch, b)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := bc.switchBranch(ancestor, oldBranch, newBranch); err != nil {
+		return nil, err
+	}
+
+	included := make(map[types.Hash]bool)
+	for _, b := range newBranch {
+		for _, tx := range b.Transactions {
+			included[tx.Hash(TxHasher{})] = true
+		}
+	}
+	dropped := []*Transaction{}
+	for _, b := range oldBranch {
+		for _, tx := range b.Transactions {
+			if !included[tx.Hash(TxHasher{})] {
+				dropped = append(dropped, tx)
+			}
+		}
+	}
+
+	bc.Logger.Log(
+		"msg", "chain reorganized",
+		"ancestor", ancestor.Height,
+		"removed", len(oldBranch),
+		"added", len(newBranch),
+		"height", bc.Height(),
+	)
+	return &Reorg{
+		Ancestor:  ancestor.Header,
+		OldBranch: oldBranch,
+		NewBranch: newBranch,
+		Dropped:   dropped,
+	}, nil
+}
+
+// switchBranch replaces the canonical blocks above the ancestor with the
+// new branch, the old ones become a side branch.
+func (bc *BlockChain) switchBranch(ancestor *Block, oldBranch, newBranch []*Block) error {
+	if err := bc.rewind(ancestor.Height); err != nil {
+		return err
+	}
+	for _, b := range oldBranch {
+		bc.addSideBlock(b)
+	}
+
+	for i, b := range newBranch {
+		bc.removeSideBlock(b)
+		err := bc.applyBlock(b)
+		if err == nil {
+			continue
+		}
+		bc.Logger.Log("msg", "reorg failed, restoring the previous branch", "height", b.Height, "err", err)
+		for _, bad := range newBranch[i:] {
+			bc.removeSideBlock(bad)
+		}
+		if rerr := bc.rewind(ancestor.Height); rerr != nil {
+			return rerr
+		}
+		for _, old := range oldBranch {
+			bc.removeSideBlock(old)
+			if rerr := bc.applyBlock(old); rerr != nil {
+				return rerr
+			}
+		}
+		for _, good := range newBranch[:i] {
+			bc.addSideBlock(good)
+		}
+		return err
+	}
+	return nil
+}
+
+// rewind reverts the state and removes the canonical blocks above the
+// given height.
+func (bc *BlockChain) rewind(height uint32) error {
+	tip := bc.Height()
+	for h := tip; h > height; h-- {
+		bc.revertBlockState(h)
+	}
+	if err := bc.store.Rewind(height); err != nil {
+		return err
+	}
+	// readers that got a block of the old branch from the store before it
+	// was rewound see the count change and leave the cache alone
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	bc.height = height
+	bc.rewinds++
+	for h := tip; h > height; h-- {
+		bc.cache.Remove(h)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// forkBlock proposes a block with a transaction carrying data on top of the
+// tip of the builder and adds it there, so the next one can follow.
+func forkBlock(t *testing.T, builder *BlockChain, data string) *Block {
+	tx := NewTransaction([]byte(data))
+	assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+	return mustAdd(t, builder, proposeBlock(t, builder, tx))
+}
+
+func TestLongestChainPrefer(t *testing.T) {
+	low := &Header{Height: 1}
+	high := &Header{Height: 2}
+	assert.True(t, LongestChain{}.Prefer(low, high))
+	assert.False(t, LongestChain{}.Prefer(high, low))
+
+	a := &Header{Height: 1, Timestamp: 1}
+	b := &Header{Height: 1, Timestamp: 2}
+	assert.False(t, LongestChain{}.Prefer(a, b))
+	assert.NotEqual(t, LongestChain{PreferLowerHash: true}.Prefer(a, b), LongestChain{PreferLowerHash: true}.Prefer(b, a))
+}
+
+func TestAddSideBlock(t *testing.T) {
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{ForkChoice: LongestChain{}}, randBlock(t, 0, [32]byte{}))
+	assert.Nil(t, err)
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+
+	a1 := forkBlock(t, newBuilder(t, bc), "a1")
+	b1 := forkBlock(t, newBuilder(t, bc), "b1")
+	assert.Nil(t, bc.AddBlock(a1))
+	assert.Nil(t, bc.AddBlock(b1))
+	assert.ErrorIs(t, bc.AddBlock(b1), ErrBlockKnown)
+
+	// first seen wins on equal height
+	tip, err := bc.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, a1.Hash(BlockHasher{}), tip.Hash(BlockHasher{}))
+	assert.True(t, bc.HasBlockHash(b1.Hash(BlockHasher{})))
+	assert.Len(t, bc.forks[genesis.PrevBlockHash], 0)
+	assert.Len(t, bc.forks[BlockHasher{}.Hash(genesis)], 1)
+}
+
+func TestReorg(t *testing.T) {
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{ForkChoice: LongestChain{}}, randBlock(t, 0, [32]byte{}))
+	assert.Nil(t, err)
+
+	a, b := newBuilder(t, bc), newBuilder(t, bc)
+	a1 := forkBlock(t, a, "a1")
+	a2 := forkBlock(t, a, "a2")
+	assert.Nil(t, bc.AddBlock(a1))
+	assert.Nil(t, bc.AddBlock(a2))
+
+	sub := bc.Subscribe(0)
+	defer sub.Unsubscribe()
+
+	tx := NewTransaction([]byte("b1"))
+	assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+	b1 := mustAdd(t, b, proposeBlock(t, b, tx, a1.Transactions[0]))
+	b2 := forkBlock(t, b, "b2")
+	b3 := forkBlock(t, b, "b3")
+	assert.Nil(t, bc.AddBlock(b1))
+	assert.Nil(t, bc.AddBlock(b2))
+	assert.Nil(t, pendingReorg(sub))
+	assert.Nil(t, bc.AddBlock(b3))
+
+	reorg := pendingReorg(sub)
+	assert.NotNil(t, reorg)
+	assert.Equal(t, uint32(3), bc.Height())
+	assert.Equal(t, uint32(0), reorg.Ancestor.Height)
+	assert.Len(t, reorg.OldBranch, 2)
+	assert.Len(t, reorg.NewBranch, 3)
+	// a1's transaction made it into b1, only a2's one is dropped
+	assert.Len(t, reorg.Dropped, 1)
+	assert.Equal(t, []byte("a2"), reorg.Dropped[0].Data)
+
+	for _, b := range []*Block{b1, b2, b3} {
+		fetched, err := bc.GetBlock(b.Height)
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(BlockHasher{}), fetched.Hash(BlockHasher{}))
+	}
+	_, err = bc.GetTxByHash(a2.Transactions[0].Hash(TxHasher{}))
+	assert.NotNil(t, err)
+
+	// the old branch is kept as a side branch and can win again
+	a3 := forkBlock(t, a, "a3")
+	a4 := forkBlock(t, a, "a4")
+	assert.Nil(t, bc.AddBlock(a3))
+	assert.Nil(t, bc.AddBlock(a4))
+	assert.Equal(t, uint32(4), bc.Height())
+	tip, err := bc.GetBlock(4)
+	assert.Nil(t, err)
+	assert.Equal(t, a4.Hash(BlockHasher{}), tip.Hash(BlockHasher{}))
+}
+
+func TestReorgOnTieBreak(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	a1 := forkBlock(t, newBuilder(t, bc), "a1")
+	b1 := forkBlock(t, newBuilder(t, bc), "b1")
+	assert.Nil(t, bc.AddBlock(a1))
+	assert.Nil(t, bc.AddBlock(b1))
+
+	winner := a1
+	if (LongestChain{PreferLowerHash: true}).Prefer(a1.Header, b1.Header) {
+		winner = b1
+	}
+	tip, err := bc.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, winner.Hash(BlockHasher{}), tip.Hash(BlockHasher{}))
+}
+
+func TestReorgFileStore(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, [32]byte{})
+	bc := newFileStoreChain(t, dir, genesis)
+
+	builder := newBuilder(t, bc)
+	a1 := forkBlock(t, newBuilder(t, bc), "a1")
+	b1 := forkBlock(t, builder, "b1")
+	b2 := forkBlock(t, builder, "b2")
+	for _, b := range []*Block{a1, b1, b2} {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Nil(t, bc.Close())
+
+	bc = newFileStoreChain(t, dir, genesis)
+	defer bc.Close()
+	assert.Equal(t, uint32(2), bc.Height())
+	b, err := bc.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, b1.Hash(BlockHasher{}), b.Hash(BlockHasher{}))
+	_, err = bc.GetBlockByHash(a1.Hash(BlockHasher{}))
+	assert.NotNil(t, err)
+}
+
+func TestPruneSideBlocks(t *testing.T) {
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{MaxForkDepth: 2}, randBlock(t, 0, [32]byte{}))
+	assert.Nil(t, err)
+	side := forkBlock(t, newBuilder(t, bc), "side")
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, bc.AddBlock(blockWithCode(t, bc, []byte("main"))))
+		if i == 0 {
+			assert.Nil(t, bc.AddBlock(side))
+			assert.Len(t, bc.sideBlocks, 1)
+		}
+	}
+	assert.Len(t, bc.sideBlocks, 0)
+	assert.NotNil(t, bc.AddBlock(forkBlock(t, newBuilder(t, bc), "too deep")))
+}
+
+func TestReorgKeepsOrphansOutOfCache(t *testing.T) {
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{ForkChoice: LongestChain{}}, randBlock(t, 0, [32]byte{}))
+	assert.Nil(t, err)
+	a, b := newBuilder(t, bc), newBuilder(t, bc)
+	a1 := forkBlock(t, a, "a1")
+	assert.Nil(t, bc.AddBlock(a1))
+	b1, b2 := forkBlock(t, b, "b1"), forkBlock(t, b, "b2")
+	assert.Nil(t, bc.AddBlock(b1))
+
+	// a reader got a1 from the store just before the reorg
+	bc.cache.Remove(1)
+	bc.lock.RLock()
+	rewinds := bc.rewinds
+	bc.lock.RUnlock()
+	orphan, err := bc.store.Get(1)
+	assert.Nil(t, err)
+	assert.Nil(t, bc.AddBlock(b2))
+	bc.cacheBlock(orphan, rewinds)
+
+	got, err := bc.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, b1.Hash(BlockHasher{}), got.Hash(BlockHasher{}))
+}
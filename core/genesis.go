@@ -0,0 +1,281 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"myblockchain/types"
+	"os"
+	"sort"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes itself in JSON as a
+// string like "5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type ConsensusParams struct {
+	// BlockTime is the interval in which validators produce blocks.
+	BlockTime Duration `json:"blockTime"`
+	// BlockReward is credited to the proposer of every block on top of the
+	// fees of its transactions.
+	BlockReward uint64 `json:"blockReward,omitempty"`
+	// MaxBlockBytes bounds the encoded size of the transactions of a
+	// block, MaxBlockTxs their number and MaxBlockCost the instructions
+	// they execute together. Zero means no limit.
+	MaxBlockBytes uint32 `json:"maxBlockBytes,omitempty"`
+	MaxBlockTxs   uint32 `json:"maxBlockTxs,omitempty"`
+	MaxBlockCost  uint64 `json:"maxBlockCost,omitempty"`
+	// MedianTimeBlocks makes the timestamp of a block come after the median
+	// timestamp of that many previous blocks, zero disables the rule.
+	MedianTimeBlocks uint32 `json:"medianTimeBlocks,omitempty"`
+}
+
+// Genesis describes the starting point of a network. Every node that loads
+// the same genesis ends up with the same genesis block and initial state.
+type Genesis struct {
+	ChainID   uint32 `json:"chainId"`
+	Timestamp uint64 `json:"timestamp"`
+	// State holds the initial state entries as hex encoded key/value pairs.
+	State map[string]string `json:"state,omitempty"`
+	// Alloc holds the initial balances by hex encoded address.
+	Alloc map[string]uint64 `json:"alloc,omitempty"`
+	// Validators holds the hex encoded addresses that are allowed to sign
+	// blocks, if empty every validator is accepted.
+	Validators []string        `json:"validators,omitempty"`
+	Consensus  ConsensusParams `json:"consensus"`
+}
+
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		ChainID: 1,
+		Consensus: ConsensusParams{
+			BlockTime:     Duration(5 * time.Second),
+			MaxBlockBytes: 1 << 20,
+			MaxBlockTxs:   1000,
+			MaxBlockCost:  1 << 20,
+		},
+	}
+}
+
+func LoadGenesis(path string) (*Genesis, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := new(Genesis)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(g); err != nil {
+		return nil, fmt.Errorf("invalid genesis file %s: %s", path, err)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis file %s: %s", path, err)
+	}
+	return g, nil
+}
+
+func (g *Genesis) Validate() error {
+	if _, err := g.stateEntries(); err != nil {
+		return err
+	}
+	if _, err := g.validatorAddresses(); err != nil {
+		return err
+	}
+	if _, err := g.allocations(); err != nil {
+		return err
+	}
+	if g.Consensus.BlockTime < 0 {
+		return fmt.Errorf("block time (%s) cannot be negative", time.Duration(g.Consensus.BlockTime))
+	}
+	return nil
+}
+
+type stateEntry struct {
+	key   []byte
+	value []byte
+}
+
+// stateEntries returns the decoded initial state sorted by key.
+func (g *Genesis) stateEntries() ([]stateEntry, error) {
+	entries := make([]stateEntry, 0, len(g.State))
+	for k, v := range g.State {
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state key %q: %s", k, err)
+		}
+		value, err := hex.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid state value for key %q: %s", k, err)
+		}
+		entries = append(entries, stateEntry{key: key, value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	for i := 1; i < len(entries); i++ {
+		if bytes.Equal(entries[i-1].key, entries[i].key) {
+			return nil, fmt.Errorf("duplicate state key %x", entries[i].key)
+		}
+	}
+	return entries, nil
+}
+
+func parseAddress(s string) (types.Address, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return types.Address{}, err
+	}
+	if len(b) != len(types.Address{}) {
+		return types.Address{}, fmt.Errorf("expected %d bytes", len(types.Address{}))
+	}
+	return types.AddressFromBytes(b), nil
+}
+
+func (g *Genesis) validatorAddresses() ([]types.Address, error) {
+	addrs := make([]types.Address, len(g.Validators))
+	for i, v := range g.Validators {
+		addr, err := parseAddress(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validator address %q: %s", v, err)
+		}
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+type allocation struct {
+	addr    types.Address
+	balance uint64
+}
+
+// allocations returns the decoded initial balances sorted by address.
+func (g *Genesis) allocations() ([]allocation, error) {
+	allocs := make([]allocation, 0, len(g.Alloc))
+	for a, balance := range g.Alloc {
+		addr, err := parseAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alloc address %q: %s", a, err)
+		}
+		allocs = append(allocs, allocation{addr: addr, balance: balance})
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		return bytes.Compare(allocs[i].addr[:], allocs[j].addr[:]) < 0
+	})
+	for i := 1; i < len(allocs); i++ {
+		if allocs[i-1].addr == allocs[i].addr {
+			return nil, fmt.Errorf("duplicate alloc address %s", allocs[i].addr)
+		}
+	}
+	return allocs, nil
+}
+
+// Hash commits to the decoded content of the genesis, so formatting
+// differences of the file (key order, hex case, whitespace) do not matter.
+func (g *Genesis) Hash() (types.Hash, error) {
+	entries, err := g.stateEntries()
+	if err != nil {
+		return types.Hash{}, err
+	}
+	validators, err := g.validatorAddresses()
+	if err != nil {
+		return types.Hash{}, err
+	}
+	allocs, err := g.allocations()
+	if err != nil {
+		return types.Hash{}, err
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, g.ChainID)
+	binary.Write(buf, binary.BigEndian, g.Timestamp)
+	binary.Write(buf, binary.BigEndian, uint32(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.BigEndian, uint32(len(e.key)))
+		buf.Write(e.key)
+		binary.Write(buf, binary.BigEndian, uint32(len(e.value)))
+		buf.Write(e.value)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(validators)))
+	for _, v := range validators {
+		buf.Write(v[:])
+	}
+	binary.Write(buf, binary.BigEndian, int64(g.Consensus.BlockTime))
+	binary.Write(buf, binary.BigEndian, g.Consensus.BlockReward)
+	binary.Write(buf, binary.BigEndian, g.Consensus.MaxBlockBytes)
+	binary.Write(buf, binary.BigEndian, g.Consensus.MaxBlockTxs)
+	binary.Write(buf, binary.BigEndian, g.Consensus.MaxBlockCost)
+	binary.Write(buf, binary.BigEndian, g.Consensus.MedianTimeBlocks)
+	binary.Write(buf, binary.BigEndian, uint32(len(allocs)))
+	for _, a := range allocs {
+		buf.Write(a.addr[:])
+		binary.Write(buf, binary.BigEndian, a.balance)
+	}
+	return sha256.Sum256(buf.Bytes()), nil
+}
+
+// ToBlock returns the genesis block. It carries no transactions and no
+// signature, its data hash commits to the genesis itself.
+func (g *Genesis) ToBlock() (*Block, error) {
+	hash, err := g.Hash()
+	if err != nil {
+		return nil, err
+	}
+	state := NewState()
+	if err := g.Commit(state); err != nil {
+		return nil, err
+	}
+	header := &Header{
+		Version:      1,
+		ChainID:      g.ChainID,
+		DataHash:     hash,
+		StateRoot:    state.Root(),
+		ReceiptsRoot: EmptyMerkleRoot,
+		Height:       0,
+		Timestamp:    g.Timestamp,
+	}
+	return NewBlock(header, nil), nil
+}
+
+// Commit writes the initial state entries and balances into the given
+// state.
+func (g *Genesis) Commit(s *State) error {
+	entries, err := g.stateEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := s.Put(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	allocs, err := g.allocations()
+	if err != nil {
+		return err
+	}
+	for _, a := range allocs {
+		if err := s.PutAccount(a.addr, &Account{Balance: a.balance}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"myblockchain/crypto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGenesis = `{
+	"chainId": 7,
+	"timestamp": 1700000000000000000,
+	"state": {
+		"61626364": "0100000000000000"
+	},
+	"validators": [%q],
+	"consensus": {
+		"blockTime": "2s"
+	}
+}`
+
+func writeGenesis(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadGenesis(t *testing.T) {
+	validator := crypto.GeneratePrivateKey().PublicKey().Address()
+	g, err := LoadGenesis(writeGenesis(t, fmt.Sprintf(testGenesis, validator.String())))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), g.ChainID)
+	assert.Equal(t, Duration(2*time.Second), g.Consensus.BlockTime)
+
+	_, err = LoadGenesis(writeGenesis(t, `{"chainId": 1, "foo": "bar"}`))
+	assert.NotNil(t, err)
+	_, err = LoadGenesis(writeGenesis(t, `{"validators": ["abcd"]}`))
+	assert.NotNil(t, err)
+	_, err = LoadGenesis(writeGenesis(t, `{"state": {"zz": "00"}}`))
+	assert.NotNil(t, err)
+}
+
+func TestGenesisHashIsDeterministic(t *testing.T) {
+	validator := crypto.GeneratePrivateKey().PublicKey().Address()
+	a, err := LoadGenesis(writeGenesis(t, fmt.Sprintf(testGenesis, validator.String())))
+	assert.Nil(t, err)
+	// same content, different formatting
+	b, err := LoadGenesis(writeGenesis(t, fmt.Sprintf(`{"consensus":{"blockTime":"2000ms"},"validators":[%q],"state":{"61626364":"0100000000000000"},"timestamp":1700000000000000000,"chainId":7}`, validator.String())))
+	assert.Nil(t, err)
+
+	ba, err := a.ToBlock()
+	assert.Nil(t, err)
+	bb, err := b.ToBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, ba.Hash(BlockHasher{}), bb.Hash(BlockHasher{}))
+
+	b.ChainID = 8
+	bb, err = b.ToBlock()
+	assert.Nil(t, err)
+	assert.NotEqual(t, ba.Hash(BlockHasher{}), bb.Hash(BlockHasher{}))
+}
+
+func TestNewBlockChainFromGenesis(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	g, err := LoadGenesis(writeGenesis(t, fmt.Sprintf(testGenesis, privKey.PublicKey().Address().String())))
+	assert.Nil(t, err)
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{}, g)
+	assert.Nil(t, err)
+	assert.Equal(t, g, bc.Genesis())
+
+	value, err := bc.contractState.Get([]byte("abcd"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deserializeInt64(value))
+
+	genesis, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+	assert.Equal(t, g.ChainID, genesis.ChainID)
+	assert.Equal(t, bc.contractState.Root(), genesis.StateRoot)
+
+	// blocks of unknown validators are rejected
+	assert.ErrorIs(t, bc.AddBlock(blockWithCode(t, bc, []byte("foo"))), ErrNotValidator)
+
+	b, err := bc.ProposeBlock(privKey, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, bc.AddBlock(b))
+}
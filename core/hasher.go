@@ -18,7 +18,9 @@ func (BlockHasher) Hash(b *Header) types.Hash {
 
 type TxHasher struct{}
 
+// Hash covers every field of the transaction but its signature, so the hash
+// stays the same however the signature is encoded.
 func (TxHasher) Hash(tx *Transaction) types.Hash {
-	h := sha256.Sum256(tx.Data)
+	h := sha256.Sum256(encodeTxPayload(tx))
 	return types.Hash(h)
 }
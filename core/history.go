@@ -0,0 +1,138 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"myblockchain/types"
+)
+
+var ErrStatePruned = errors.New("state is pruned")
+
+// StateView is a read-only view of the chain state after the block with the
+// given header. Blocks added later do not change it, and reading it never
+// waits for a block to be added.
+type StateView struct {
+	*State
+	Header *Header
+}
+
+// StateView returns the view of the state at the tip of the chain.
+func (bc *BlockChain) StateView() *StateView {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	return bc.head
+}
+
+// StateViewAt returns the view of the state after the block at the given
+// height. States below the ones kept in memory are only read on an archive
+// node: the checkpoint at or below the height is loaded and the state diffs
+// of at most CheckpointInterval-1 blocks are applied to it.
+func (bc *BlockChain) StateViewAt(height uint32) (*StateView, error) {
+	bc.lock.RLock()
+	tip := bc.head.Header.Height
+	view, ok := bc.versions[height]
+	bc.lock.RUnlock()
+	if height > tip {
+		return nil, fmt.Errorf("given height (%d) too high", height)
+	}
+	if ok {
+		return view, nil
+	}
+	// only archive nodes read below the heights kept in memory, a height
+	// missing from them is being reorganized
+	if !bc.archive || height+bc.stateHistory+1 >= tip {
+		return nil, fmt.Errorf("%w: cannot read the state at height (%d)", ErrStatePruned, height)
+	}
+	if view, ok := bc.pastStates.Get(height); ok {
+		return view, nil
+	}
+	view, err := bc.readPastState(height)
+	if err != nil {
+		return nil, err
+	}
+	bc.pastStates.Add(height, view)
+	return view, nil
+}
+
+// readPastState rebuilds the state after the block at the given height from
+// the store. Only blocks that can no longer be reorganized are read, so
+// what is read never changes.
+func (bc *BlockChain) readPastState(height uint32) (*StateView, error) {
+	from, err := bc.store.StateCheckpointBelow(height)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, ok := bc.checkpoints.Get(from)
+	if !ok {
+		b, err := bc.store.Get(from)
+		if err != nil {
+			return nil, err
+		}
+		if checkpoint, err = bc.loadCheckpoint(b.Header); err != nil {
+			return nil, err
+		}
+		bc.checkpoints.Add(from, checkpoint)
+	}
+	s := checkpoint.Child()
+	for h := from + 1; h <= height; h++ {
+		diff, err := bc.store.GetStateDiff(h)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range diff.Changes {
+			if c.Kind == KeyDeleted {
+				err = s.Delete(string(c.Key))
+			} else {
+				err = s.Put(c.Key, c.New)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	b, err := bc.store.Get(height)
+	if err != nil {
+		return nil, err
+	}
+	if s.Root() != b.StateRoot {
+		return nil, fmt.Errorf("%w: state diffs up to block (%d) do not match its state root", ErrStoreCorrupted, height)
+	}
+	return &StateView{State: s.View(), Header: b.Header}, nil
+}
+
+// GetStateAt returns the value of the key in the state after the block at
+// the given height.
+func (bc *BlockChain) GetStateAt(key []byte, height uint32) ([]byte, error) {
+	view, err := bc.StateViewAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return view.Get(key)
+}
+
+// GetAccountAt returns the account of the address after the block at the
+// given height.
+func (bc *BlockChain) GetAccountAt(addr types.Address, height uint32) (*Account, error) {
+	view, err := bc.StateViewAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return view.GetAccount(addr)
+}
+
+// GetStateProof returns the proof of the value of the key at the tip of the
+// chain together with the header whose state root it leads to.
+func (bc *BlockChain) GetStateProof(key []byte) (*StateProof, *Header, error) {
+	view := bc.StateView()
+	return view.Prove(key), view.Header, nil
+}
+
+// GetStateProofAt returns the proof of the value of the key after the block
+// at the given height together with the header of the block.
+func (bc *BlockChain) GetStateProofAt(key []byte, height uint32) (*StateProof, *Header, error) {
+	view, err := bc.StateViewAt(height)
+	if err != nil {
+		return nil, nil, err
+	}
+	return view.Prove(key), view.Header, nil
+}
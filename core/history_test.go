@@ -0,0 +1,245 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateAtHeight(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	for i := uint64(0); i < 3; i++ {
+		mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 10)))
+	}
+
+	for h := uint32(0); h <= bc.Height(); h++ {
+		account, err := bc.GetAccountAt(alice.PublicKey().Address(), h)
+		assert.Nil(t, err)
+		assert.Equal(t, &Account{Balance: 100 - 10*uint64(h), Nonce: uint64(h)}, account)
+
+		header, err := bc.GetHeader(h)
+		assert.Nil(t, err)
+		view, err := bc.StateViewAt(h)
+		assert.Nil(t, err)
+		assert.Equal(t, header, view.Header)
+		assert.Equal(t, header.StateRoot, view.Root())
+		proof, proofHeader, err := bc.GetStateProofAt(accountKey(bob.PublicKey().Address()), h)
+		assert.Nil(t, err)
+		assert.Equal(t, header, proofHeader)
+		assert.Equal(t, h > 0, proof.Exists)
+		assert.True(t, proof.Verify(header.StateRoot))
+	}
+
+	_, err := bc.GetStateAt(accountKey(bob.PublicKey().Address()), 0)
+	assert.NotNil(t, err)
+	_, err = bc.GetStateAt(accountKey(bob.PublicKey().Address()), bc.Height()+1)
+	assert.NotNil(t, err)
+	// reading the past leaves the chain state alone
+	assertAccount(t, bc, bob, 30, 0)
+}
+
+func TestStateHistoryIsPruned(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	for _, archive := range []bool{false, true} {
+		g := DefaultGenesis()
+		g.Alloc = map[string]uint64{alice.PublicKey().Address().String(): 100}
+		bc, err := NewBlockChainFromGenesis(BlockChainOptions{MaxForkDepth: 2, StateHistory: 3, Archive: archive}, g)
+		assert.Nil(t, err)
+		for i := uint64(0); i < 6; i++ {
+			mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 1)))
+		}
+
+		_, err = bc.GetAccountAt(alice.PublicKey().Address(), 2)
+		assert.Nil(t, err)
+		_, err = bc.GetAccountAt(alice.PublicKey().Address(), 1)
+		if archive {
+			assert.Nil(t, err)
+		} else {
+			assert.ErrorIs(t, err, ErrStatePruned)
+		}
+	}
+}
+
+func TestStateViewIsPinned(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	view := bc.StateView()
+	mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, 0, 10)))
+
+	account, err := view.GetAccount(alice.PublicKey().Address())
+	assert.Nil(t, err)
+	assert.Equal(t, &Account{Balance: 100}, account)
+	assert.Equal(t, uint32(0), view.Header.Height)
+	assert.Equal(t, view.Header.StateRoot, view.Root())
+	assert.Equal(t, uint32(1), bc.StateView().Header.Height)
+}
+
+func TestReadersDoNotWaitForBlocks(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 1000)
+
+	// a block being added holds the add lock for as long as it executes
+	bc.addLock.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := bc.GetAccount(alice.PublicKey().Address())
+		assert.Nil(t, err)
+		_, _, err = bc.GetStateProof(accountKey(alice.PublicKey().Address()))
+		assert.Nil(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reading the state waited for the add lock")
+	}
+	bc.addLock.Unlock()
+
+	// readers run alongside the writer and always see a whole block
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				view := bc.StateView()
+				account, err := view.GetAccount(bob.PublicKey().Address())
+				assert.Nil(t, err)
+				assert.Equal(t, uint64(view.Header.Height), account.Balance)
+			}
+		}()
+	}
+	for i := uint64(0); i < 20; i++ {
+		mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 1)))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// countingStore counts what is read from the store to rebuild states.
+type countingStore struct {
+	Storage
+	diffReads    int
+	receiptReads int
+}
+
+func (s *countingStore) GetStateDiff(height uint32) (*StateDiff, error) {
+	s.diffReads++
+	return s.Storage.GetStateDiff(height)
+}
+
+func (s *countingStore) GetReceipts(height uint32) ([]*Receipt, error) {
+	s.receiptReads++
+	return s.Storage.GetReceipts(height)
+}
+
+func newArchiveChain(t *testing.T, store Storage, alice crypto.PrivateKey) *BlockChain {
+	g := DefaultGenesis()
+	g.Alloc = map[string]uint64{alice.PublicKey().Address().String(): 1000}
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{
+		Store:              store,
+		MaxForkDepth:       2,
+		StateHistory:       2,
+		Archive:            true,
+		CheckpointInterval: 4,
+	}, g)
+	assert.Nil(t, err)
+	return bc
+}
+
+func TestArchiveReadsAreBounded(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	store := &countingStore{Storage: NewMemoryStore()}
+	bc := newArchiveChain(t, store, alice)
+	for i := uint64(0); i < 20; i++ {
+		mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 1)))
+	}
+	// only the last blocks are kept in memory
+	assert.LessOrEqual(t, len(bc.versions), 4)
+
+	for h := uint32(0); h <= bc.Height(); h++ {
+		store.diffReads = 0
+		account, err := bc.GetAccountAt(alice.PublicKey().Address(), h)
+		assert.Nil(t, err)
+		assert.Equal(t, &Account{Balance: 1000 - uint64(h), Nonce: uint64(h)}, account)
+		assert.Less(t, store.diffReads, 4)
+	}
+	store.diffReads = 0
+	_, err := bc.GetAccountAt(alice.PublicKey().Address(), 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, store.diffReads)
+}
+
+func TestArchiveSurvivesReopen(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir)
+	assert.Nil(t, err)
+	bc := newArchiveChain(t, fs, alice)
+	for i := uint64(0); i < 20; i++ {
+		mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 1)))
+	}
+	assert.Nil(t, bc.Close())
+
+	fs, err = NewFileStore(dir)
+	assert.Nil(t, err)
+	store := &countingStore{Storage: fs}
+	bc = newArchiveChain(t, store, alice)
+	defer bc.Close()
+	// the state is replayed from the last checkpoint below the blocks kept
+	// in memory, not from genesis
+	assert.LessOrEqual(t, store.receiptReads, 7)
+	assertAccount(t, bc, alice, 980, 20)
+
+	for h := uint32(0); h <= bc.Height(); h++ {
+		account, err := bc.GetAccountAt(alice.PublicKey().Address(), h)
+		assert.Nil(t, err)
+		assert.Equal(t, &Account{Balance: 1000 - uint64(h), Nonce: uint64(h)}, account)
+	}
+	mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, 20, 1)))
+	assertAccount(t, bc, bob, 21, 0)
+}
+
+func TestPrunedNodeKeepsOneCheckpoint(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	dir := t.TempDir()
+	g := DefaultGenesis()
+	g.Alloc = map[string]uint64{alice.PublicKey().Address().String(): 1000}
+	open := func() *BlockChain {
+		store, err := NewFileStore(dir)
+		assert.Nil(t, err)
+		bc, err := NewBlockChainFromGenesis(BlockChainOptions{Store: store, MaxForkDepth: 2, StateHistory: 2, CheckpointInterval: 4}, g)
+		assert.Nil(t, err)
+		return bc
+	}
+	bc := open()
+	for i := uint64(0); i < 20; i++ {
+		mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, i, 1)))
+	}
+	height, err := bc.store.StateCheckpointBelow(bc.Height())
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(16), height)
+	files, err := os.ReadDir(filepath.Join(dir, "checkpoints"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	assert.Nil(t, bc.Close())
+
+	// the one checkpoint is enough to restart
+	bc = open()
+	defer bc.Close()
+	assertAccount(t, bc, alice, 980, 20)
+	mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, bob, 20, 1)))
+	assertAccount(t, bc, bob, 21, 0)
+}
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"fmt"
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"sync"
+
+	"github.com/go-kit/log"
+)
+
+// SignedHeader is a block header together with the signature of the
+// validator that produced it, everything a light client needs to follow
+// the chain.
+type SignedHeader struct {
+	*Header
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+}
+
+// SignedHeader strips the transactions off the block.
+func (b *Block) SignedHeader() *SignedHeader {
+	return &SignedHeader{
+		Header:    b.Header,
+		Validator: b.Validatar,
+		Signature: b.Signature,
+	}
+}
+
+func (h *SignedHeader) Hash() types.Hash {
+	return BlockHasher{}.Hash(h.Header)
+}
+
+func (h *SignedHeader) Verify() error {
+	if h.Signature == nil {
+		return fmt.Errorf("header (%d) is not signed", h.Height)
+	}
+	if !h.Signature.Verify(h.Header.Bytes(), h.Validator) {
+		return fmt.Errorf("header (%d) signature is invalid", h.Height)
+	}
+	return nil
+}
+
+// TxProof proves that a transaction is included in a block.
+type TxProof struct {
+	BlockHash types.Hash
+	Tx        *Transaction
+	// Proof leads from the hash of the transaction to the data hash of the
+	// block.
+	Proof *MerkleProof
+}
+
+// Verify checks the proof against the header of the block it claims the
+// transaction is included in and returns the transaction.
+func (p *TxProof) Verify(h *Header, txHash types.Hash) (*Transaction, error) {
+	if (BlockHasher{}).Hash(h) != p.BlockHash {
+		return nil, fmt.Errorf("proof is for block (%s), not (%s)", p.BlockHash, BlockHasher{}.Hash(h))
+	}
+	if p.Tx == nil || p.Proof == nil {
+		return nil, fmt.Errorf("proof is incomplete")
+	}
+	if p.Tx.Hash(TxHasher{}) != txHash {
+		return nil, fmt.Errorf("proof is for tx (%s), not (%s)", p.Tx.Hash(TxHasher{}), txHash)
+	}
+	if !p.Proof.Verify(h.DataHash, txHash) {
+		return nil, fmt.Errorf("proof does not match the data hash of block (%d)", h.Height)
+	}
+	if err := p.Tx.Verify(); err != nil {
+		return nil, err
+	}
+	return p.Tx, nil
+}
+
+// GetTxProof returns the proof of inclusion of a transaction on the
+// canonical chain.
+func (bc *BlockChain) GetTxProof(hash types.Hash) (*TxProof, error) {
+	_, loc, err := bc.store.GetTx(hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bc.GetBlock(loc.Height)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := NewMerkleProof(txLeaves(b.Transactions), int(loc.Index))
+	if err != nil {
+		return nil, err
+	}
+	return &TxProof{
+		BlockHash: b.Hash(BlockHasher{}),
+		Tx:        b.Transactions[loc.Index],
+		Proof:     proof,
+	}, nil
+}
+
+// LightChain follows the chain by its signed headers only. Transactions and
+// blocks are fetched on demand and checked against the headers.
+type LightChain struct {
+	Logger     log.Logger
+	lock       sync.RWMutex
+	headers    map[types.Hash]*SignedHeader
+	canonical  []types.Hash
+	forkChoice ForkChoice
+	// validators allowed to sign blocks, empty means everyone is
+	validators map[types.Address]bool
+}
+
+// NewLightChain creates a light chain that starts at the given genesis.
+func NewLightChain(l log.Logger, g *Genesis) (*LightChain, error) {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	genesis, err := g.ToBlock()
+	if err != nil {
+		return nil, err
+	}
+	validators, err := g.validatorAddresses()
+	if err != nil {
+		return nil, err
+	}
+	lc := &LightChain{
+		Logger:     l,
+		headers:    make(map[types.Hash]*SignedHeader),
+		forkChoice: LongestChain{PreferLowerHash: true},
+		validators: make(map[types.Address]bool),
+	}
+	for _, addr := range validators {
+		lc.validators[addr] = true
+	}
+	hash := genesis.Hash(BlockHasher{})
+	lc.headers[hash] = genesis.SignedHeader()
+	lc.canonical = []types.Hash{hash}
+	return lc, nil
+}
+
+func (lc *LightChain) Height() uint32 {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	return uint32(len(lc.canonical) - 1)
+}
+
+// GetHeader returns the canonical header at the given height.
+func (lc *LightChain) GetHeader(height uint32) (*Header, error) {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	if int(height) >= len(lc.canonical) {
+		return nil, fmt.Errorf("given height (%d) too high", height)
+	}
+	return lc.headers[lc.canonical[height]].Header, nil
+}
+
+// GetHeaderByHash returns a canonical header.
+func (lc *LightChain) GetHeaderByHash(hash types.Hash) (*Header, error) {
+	lc.lock.RLock()
+	defer lc.lock.RUnlock()
+	h, ok := lc.headers[hash]
+	if !ok || !lc.isCanonical(hash, h.Height) {
+		return nil, fmt.Errorf("header with hash (%s) not on the canonical chain", hash)
+	}
+	return h.Header, nil
+}
+
+func (lc *LightChain) isCanonical(hash types.Hash, height uint32) bool {
+	return int(height) < len(lc.canonical) && lc.canonical[height] == hash
+}
+
+// AddHeader validates the header and adds it to the chain. Headers that do
+// not extend the tip are kept and become canonical once the fork choice
+// prefers their branch.
+func (lc *LightChain) AddHeader(h *SignedHeader) error {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	hash := h.Hash()
+	if _, ok := lc.headers[hash]; ok {
+		return ErrBlockKnown
+	}
+	parent, ok := lc.headers[h.PrevBlockHash]
+	if !ok {
+		return fmt.Errorf("%w: header %d has prev block hash %s", ErrUnknownParent, h.Height, h.PrevBlockHash)
+	}
+	if h.Height != parent.Height+1 {
+		return fmt.Errorf("header height %d is not the next height after its parent %d", h.Height, parent.Height)
+	}
+	if len(lc.validators) > 0 && !lc.validators[h.Validator.Address()] {
+		return fmt.Errorf("%w: %s", ErrNotValidator, h.Validator.Address())
+	}
+	if err := h.Verify(); err != nil {
+		return err
+	}
+	lc.headers[hash] = h
+
+	tip := lc.headers[lc.canonical[len(lc.canonical)-1]]
+	if h.PrevBlockHash == tip.Hash() {
+		lc.canonical = append(lc.canonical, hash)
+		return nil
+	}
+	if !lc.forkChoice.Prefer(tip.Header, h.Header) {
+		return nil
+	}
+	// walk back to where the branch leaves the canonical chain
+	branch := []types.Hash{hash}
+	for cur := h; !lc.isCanonical(cur.PrevBlockHash, cur.Height-1); {
+		cur = lc.headers[cur.PrevBlockHash]
+		branch = append([]types.Hash{cur.Hash()}, branch...)
+	}
+	ancestor := h.Height - uint32(len(branch))
+	lc.canonical = append(lc.canonical[:ancestor+1], branch...)
+	lc.Logger.Log("msg", "light chain reorganized", "ancestor", ancestor, "height", h.Height)
+	return nil
+}
+
+// VerifyTx checks the proof of inclusion of a transaction against the
+// canonical headers and returns the transaction.
+func (lc *LightChain) VerifyTx(hash types.Hash, proof *TxProof) (*Transaction, error) {
+	h, err := lc.GetHeaderByHash(proof.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	return proof.Verify(h, hash)
+}
+
+// VerifyBlock checks that a block fetched from a full node matches its
+// canonical header.
+func (lc *LightChain) VerifyBlock(b *Block) error {
+	h, err := lc.GetHeaderByHash(b.Hash(BlockHasher{}))
+	if err != nil {
+		return err
+	}
+	if h.Height != b.Height {
+		return fmt.Errorf("block (%d) does not match the header at height (%d)", b.Height, h.Height)
+	}
+	return b.verifyData()
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLightChainPair(t *testing.T, validator crypto.PrivateKey) (*BlockChain, *LightChain) {
+	g := DefaultGenesis()
+	g.Validators = []string{validator.PublicKey().Address().String()}
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{}, g)
+	assert.Nil(t, err)
+	lc, err := NewLightChain(nil, g)
+	assert.Nil(t, err)
+	return bc, lc
+}
+
+// signedBlock proposes a block on the tip of the chain and adds it.
+func signedBlock(t *testing.T, priv crypto.PrivateKey, bc *BlockChain, data ...string) *Block {
+	txs := []*Transaction{}
+	for _, d := range data {
+		tx := NewTransaction([]byte(d))
+		tx.ChainID = bc.ChainID()
+		assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+		txs = append(txs, tx)
+	}
+	b, err := bc.ProposeBlock(priv, txs)
+	assert.Nil(t, err)
+	assert.Nil(t, bc.AddBlock(b))
+	return b
+}
+
+func TestLightChainFollowsHeaders(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	bc, lc := newLightChainPair(t, validator)
+
+	b1 := signedBlock(t, validator, bc, "a", "b")
+	b2 := signedBlock(t, validator, bc, "c")
+
+	assert.ErrorIs(t, lc.AddHeader(b2.SignedHeader()), ErrUnknownParent)
+	assert.Nil(t, lc.AddHeader(b1.SignedHeader()))
+	assert.Nil(t, lc.AddHeader(b2.SignedHeader()))
+	assert.ErrorIs(t, lc.AddHeader(b2.SignedHeader()), ErrBlockKnown)
+	assert.Equal(t, uint32(2), lc.Height())
+
+	// transactions are checked against the synced headers
+	hash := b1.Transactions[1].Hash(TxHasher{})
+	proof, err := bc.GetTxProof(hash)
+	assert.Nil(t, err)
+	tx, err := lc.VerifyTx(hash, proof)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), tx.Data)
+	_, err = lc.VerifyTx(b1.Transactions[0].Hash(TxHasher{}), proof)
+	assert.NotNil(t, err)
+	proof.Proof.Index = 0
+	_, err = lc.VerifyTx(hash, proof)
+	assert.NotNil(t, err)
+
+	fetched, err := bc.GetBlock(2)
+	assert.Nil(t, err)
+	assert.Nil(t, lc.VerifyBlock(fetched))
+	tampered := NewBlock(fetched.Header, b1.Transactions)
+	assert.NotNil(t, lc.VerifyBlock(tampered))
+}
+
+func TestLightChainRejectsBadHeaders(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	bc, lc := newLightChainPair(t, validator)
+
+	b1, err := bc.ProposeBlock(crypto.GeneratePrivateKey(), nil)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, lc.AddHeader(b1.SignedHeader()), ErrNotValidator)
+
+	b1 = signedBlock(t, validator, bc)
+	h := b1.SignedHeader()
+	h.Header = &Header{Height: 1, PrevBlockHash: h.PrevBlockHash, Timestamp: h.Timestamp + 1}
+	assert.NotNil(t, lc.AddHeader(h))
+	assert.Equal(t, uint32(0), lc.Height())
+}
+
+func TestLightChainSwitchesBranch(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	bc, lc := newLightChainPair(t, validator)
+	lc.forkChoice = LongestChain{}
+
+	a1 := signedBlock(t, validator, newBuilder(t, bc), "a1")
+	b := newBuilder(t, bc)
+	b1 := signedBlock(t, validator, b, "b1")
+	b2 := signedBlock(t, validator, b, "b2")
+	assert.Nil(t, lc.AddHeader(a1.SignedHeader()))
+	assert.Nil(t, lc.AddHeader(b1.SignedHeader()))
+	header, err := lc.GetHeader(1)
+	assert.Nil(t, err)
+	assert.Equal(t, a1.Hash(BlockHasher{}), (BlockHasher{}).Hash(header))
+
+	assert.Nil(t, lc.AddHeader(b2.SignedHeader()))
+	assert.Equal(t, uint32(2), lc.Height())
+	header, err = lc.GetHeader(1)
+	assert.Nil(t, err)
+	assert.Equal(t, b1.Hash(BlockHasher{}), (BlockHasher{}).Hash(header))
+	_, err = lc.GetHeaderByHash(a1.Hash(BlockHasher{}))
+	assert.NotNil(t, err)
+	_, err = lc.GetHeaderByHash(types.Hash{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"myblockchain/types"
+)
+
+// Leaves and inner nodes are hashed with different prefixes, so an inner
+// node can never be passed off as a leaf. The root commits to the number
+// of leaves under its own prefix.
+const (
+	merkleLeafPrefix  byte = 0x00
+	merkleNodePrefix  byte = 0x01
+	merkleCountPrefix byte = 0x02
+)
+
+// EmptyMerkleRoot is the root of a tree without leaves.
+var EmptyMerkleRoot = types.Hash(sha256.Sum256(nil))
+
+// MerkleProof is the path from a leaf to the root of a binary Merkle tree.
+type MerkleProof struct {
+	Index uint32
+	// Count is the number of leaves of the tree.
+	Count uint32
+	// Hashes are the siblings of the path, from the leaf up.
+	Hashes []types.Hash
+}
+
+func merkleLeaf(h types.Hash) types.Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, h[:]...))
+}
+
+func merkleNode(left, right types.Hash) types.Hash {
+	buf := make([]byte, 1+2*len(left))
+	buf[0] = merkleNodePrefix
+	copy(buf[1:], left[:])
+	copy(buf[1+len(left):], right[:])
+	return sha256.Sum256(buf)
+}
+
+// merkleCount binds the root of the tree to its number of leaves. The shape
+// of the path of a leaf depends on the count, a proof could otherwise move
+// a leaf to another index by claiming another count.
+func merkleCount(count uint32, tree types.Hash) types.Hash {
+	buf := make([]byte, 1+4+len(tree))
+	buf[0] = merkleCountPrefix
+	binary.BigEndian.PutUint32(buf[1:5], count)
+	copy(buf[5:], tree[:])
+	return sha256.Sum256(buf)
+}
+
+// merkleLevel hashes one level of the tree into the next one. The last node
+// of a level with an odd number of nodes is carried up as it is instead of
+// being paired with itself, so no two lists of leaves share a root.
+func merkleLevel(level []types.Hash) []types.Hash {
+	next := make([]types.Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+// MerkleRoot returns the root of the tree with the given leaves, which
+// commits to their number.
+func MerkleRoot(leaves []types.Hash) types.Hash {
+	if len(leaves) == 0 {
+		return EmptyMerkleRoot
+	}
+	level := make([]types.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return merkleCount(uint32(len(leaves)), level[0])
+}
+
+// NewMerkleProof returns the proof that the leaf at the given index is part
+// of the tree with the given leaves.
+func NewMerkleProof(leaves []types.Hash, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index (%d) out of range", index)
+	}
+	proof := &MerkleProof{Index: uint32(index), Count: uint32(len(leaves))}
+	level := make([]types.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	for i := index; len(level) > 1; i /= 2 {
+		if sibling := i ^ 1; sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling])
+		}
+		level = merkleLevel(level)
+	}
+	return proof, nil
+}
+
+// Verify reports whether the proof leads from the given leaf to the root.
+// The root commits to the number of leaves, so a proof with another Count
+// does not verify.
+func (p *MerkleProof) Verify(root, leaf types.Hash) bool {
+	if p.Index >= p.Count {
+		return false
+	}
+	hash := merkleLeaf(leaf)
+	used := 0
+	for i, n := p.Index, p.Count; n > 1; i, n = i/2, (n+1)/2 {
+		sibling := i ^ 1
+		if sibling >= n {
+			continue
+		}
+		if used == len(p.Hashes) {
+			return false
+		}
+		if i%2 == 0 {
+			hash = merkleNode(hash, p.Hashes[used])
+		} else {
+			hash = merkleNode(p.Hashes[used], hash)
+		}
+		used++
+	}
+	return used == len(p.Hashes) && merkleCount(p.Count, hash) == root
+}
+
+func txLeaves(txs []*Transaction) []types.Hash {
+	leaves := make([]types.Hash, len(txs))
+	for i, tx := range txs {
+		leaves[i] = TxHasher{}.Hash(tx)
+	}
+	return leaves
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"crypto/sha256"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func merkleLeaves(n int) []types.Hash {
+	leaves := make([]types.Hash, n)
+	for i := range leaves {
+		leaves[i] = sha256.Sum256([]byte{byte(i)})
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	assert.Equal(t, EmptyMerkleRoot, MerkleRoot(nil))
+
+	leaves := merkleLeaves(3)
+	assert.Equal(t, merkleCount(1, merkleLeaf(leaves[0])), MerkleRoot(leaves[:1]))
+	expected := merkleNode(merkleNode(merkleLeaf(leaves[0]), merkleLeaf(leaves[1])), merkleLeaf(leaves[2]))
+	assert.Equal(t, merkleCount(3, expected), MerkleRoot(leaves))
+
+	// the odd node is carried up, not paired with itself
+	duplicated := append(merkleLeaves(3), leaves[2])
+	assert.NotEqual(t, MerkleRoot(leaves), MerkleRoot(duplicated))
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := merkleLeaves(n)
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			proof, err := NewMerkleProof(leaves, i)
+			assert.Nil(t, err)
+			assert.True(t, proof.Verify(root, leaves[i]), "leaf %d of %d", i, n)
+			assert.False(t, proof.Verify(root, sha256.Sum256([]byte("other"))))
+			if n > 1 {
+				proof.Index = uint32((i + 1) % n)
+				assert.False(t, proof.Verify(root, leaves[i]))
+			}
+		}
+	}
+
+	_, err := NewMerkleProof(merkleLeaves(2), 2)
+	assert.NotNil(t, err)
+	proof, err := NewMerkleProof(merkleLeaves(4), 1)
+	assert.Nil(t, err)
+	proof.Hashes = proof.Hashes[:1]
+	assert.False(t, proof.Verify(MerkleRoot(merkleLeaves(4)), merkleLeaves(4)[1]))
+}
+
+func TestMerkleProofCommitsToCount(t *testing.T) {
+	leaves := merkleLeaves(3)
+	root := MerkleRoot(leaves)
+	proof, err := NewMerkleProof(leaves, 2)
+	assert.Nil(t, err)
+	assert.True(t, proof.Verify(root, leaves[2]))
+
+	// with two leaves the last one would sit at index 1 on the same path
+	proof.Index, proof.Count = 1, 2
+	assert.False(t, proof.Verify(root, leaves[2]))
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"crypto/sha256"
+	"myblockchain/types"
+	"sort"
+)
+
+type ReceiptStatus byte
+
+const (
+	ReceiptFailed  ReceiptStatus = 0x0
+	ReceiptSuccess ReceiptStatus = 0x1
+)
+
+func (s ReceiptStatus) String() string {
+	if s == ReceiptSuccess {
+		return "success"
+	}
+	return "failed"
+}
+
+// Receipt records the outcome of executing a transaction.
+type Receipt struct {
+	TxHash      types.Hash
+	BlockHash   types.Hash
+	BlockHeight uint32
+	TxIndex     uint32
+	Status      ReceiptStatus
+	// Error is the reason the transaction failed, empty on success.
+	Error string
+	// Result is the value left on top of the stack, serialized.
+	Result []byte
+	// WrittenKeys holds the state keys the transaction wrote or deleted,
+	// sorted. Empty if the transaction failed.
+	WrittenKeys [][]byte
+	// Cost is the number of instructions executed.
+	Cost uint64
+	// Fee is what the sender paid to the proposer of the block, also when
+	// the transaction failed.
+	Fee uint64
+}
+
+// Hash commits to the outcome of the transaction. The error message and
+// where the transaction was included are left out, the block hash depends
+// on the receipts root.
+func (r *Receipt) Hash() types.Hash {
+	enc := newCodecWriter()
+	enc.byte(CodecVersion)
+	enc.hash(r.TxHash)
+	enc.uint32(r.TxIndex)
+	enc.byte(byte(r.Status))
+	enc.bytes(r.Result)
+	enc.uint32(uint32(len(r.WrittenKeys)))
+	for _, key := range r.WrittenKeys {
+		enc.bytes(key)
+	}
+	enc.uint64(r.Cost)
+	enc.uint64(r.Fee)
+	return sha256.Sum256(enc.buf.Bytes())
+}
+
+// ReceiptsRoot returns the Merkle root of the hashes of the receipts.
+func ReceiptsRoot(receipts []*Receipt) types.Hash {
+	leaves := make([]types.Hash, len(receipts))
+	for i, r := range receipts {
+		leaves[i] = r.Hash()
+	}
+	return MerkleRoot(leaves)
+}
+
+// newReceipt returns the receipt of the transaction at the given index of
+// the block with the given header. The block hash is left to the caller,
+// the header is not complete while its transactions are executed.
+func newReceipt(h *Header, index int, tx *Transaction) *Receipt {
+	return &Receipt{
+		TxHash:      tx.Hash(TxHasher{}),
+		BlockHeight: h.Height,
+		TxIndex:     uint32(index),
+	}
+}
+
+func serializeResult(v any) []byte {
+	switch r := v.(type) {
+	case int:
+		return serializeInt64(int64(r))
+	case byte:
+		return []byte{r}
+	case []byte:
+		return r
+	}
+	return nil
+}
+
+// writtenKeys returns the keys written or deleted since the snapshot was
+// taken, sorted.
+func (s *State) writtenKeys(snapshot int) [][]byte {
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, c := range s.journal[s.snapshots[snapshot].journal:] {
+		if !seen[c.key] {
+			seen[c.key] = true
+			keys = append(keys, c.key)
+		}
+	}
+	sort.Strings(keys)
+	res := make([][]byte, len(keys))
+	for i, k := range keys {
+		res[i] = []byte(k)
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"errors"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceipts(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+
+	failing := append(storeCode("foo", 1), byte(InstrAdd))
+	sub := []byte{0x08, 0x0a, 0x05, 0x0a, 0x0e}
+	b := blockWithCode(t, bc, storeCode("bar", 2), failing, sub)
+	assert.Nil(t, bc.AddBlock(b))
+
+	receipts, err := bc.GetReceipts(1)
+	assert.Nil(t, err)
+	assert.Len(t, receipts, 3)
+	assert.Equal(t, b.ReceiptsRoot, ReceiptsRoot(receipts))
+
+	ok, err := bc.GetReceipt(b.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptSuccess, ok.Status)
+	assert.Equal(t, b.Hash(BlockHasher{}), ok.BlockHash)
+	assert.Equal(t, uint32(1), ok.BlockHeight)
+	assert.Equal(t, [][]byte{[]byte("bar")}, ok.WrittenKeys)
+	assert.Equal(t, uint64(len(b.Transactions[0].Data)), ok.Cost)
+
+	failed, err := bc.GetReceipt(b.Transactions[1].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, failed.Status)
+	assert.Equal(t, uint32(1), failed.TxIndex)
+	assert.NotEmpty(t, failed.Error)
+	assert.Empty(t, failed.WrittenKeys)
+	// the write made before the failure is reverted
+	_, err = bc.contractState.Get([]byte("foo"))
+	assert.NotNil(t, err)
+
+	result, err := bc.GetReceipt(b.Transactions[2].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), deserializeInt64(result.Result))
+}
+
+func TestReceiptsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, [32]byte{})
+	bc := newFileStoreChain(t, dir, genesis)
+	builder := newBuilder(t, bc)
+	a1 := blockWithCode(t, bc, storeCode("foo", 1))
+	assert.Nil(t, bc.AddBlock(a1))
+	assert.Nil(t, bc.Close())
+
+	bc = newFileStoreChain(t, dir, genesis)
+	defer bc.Close()
+	receipt, err := bc.GetReceipt(a1.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptSuccess, receipt.Status)
+	assert.Equal(t, a1.Hash(BlockHasher{}), receipt.BlockHash)
+
+	// receipts follow the canonical chain through a reorg
+	b1 := mustAdd(t, builder, blockWithCode(t, builder, append(storeCode("foo", 1), byte(InstrAdd))))
+	b2 := mustAdd(t, builder, blockWithCode(t, builder))
+	assert.Nil(t, bc.AddBlock(b1))
+	assert.Nil(t, bc.AddBlock(b2))
+	_, err = bc.GetReceipt(a1.Transactions[0].Hash(TxHasher{}))
+	assert.NotNil(t, err)
+	receipt, err = bc.GetReceipt(b1.Transactions[0].Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, receipt.Status)
+	receipts, err := bc.GetReceipts(2)
+	assert.Nil(t, err)
+	assert.Len(t, receipts, 0)
+}
+
+// failingStore fails to write the state diff and the checkpoint of the
+// blocks at the given heights, zero for none.
+type failingStore struct {
+	Storage
+	diffAt, checkpointAt uint32
+}
+
+func (s *failingStore) PutStateDiff(height uint32, diff *StateDiff) error {
+	if s.diffAt != 0 && height == s.diffAt {
+		return errors.New("disk full")
+	}
+	return s.Storage.PutStateDiff(height, diff)
+}
+
+func (s *failingStore) PutStateCheckpoint(height uint32, entries map[string][]byte) error {
+	if s.checkpointAt != 0 && height == s.checkpointAt {
+		return errors.New("disk full")
+	}
+	return s.Storage.PutStateCheckpoint(height, entries)
+}
+
+func TestFailedWriteLeavesBlockOut(t *testing.T) {
+	store := &failingStore{Storage: NewMemoryStore(), diffAt: 1}
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{Store: store}, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, err)
+
+	b := nextBlock(t, bc)
+	assert.NotNil(t, bc.AddBlock(b))
+	assert.Equal(t, uint32(0), bc.Height())
+	assert.Equal(t, uint32(1), store.Len())
+
+	// once the store works again the chain goes on
+	store.diffAt = 0
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+	assert.Equal(t, uint32(2), bc.Height())
+}
+
+func TestFailedCheckpointKeepsBlock(t *testing.T) {
+	store := &failingStore{Storage: NewMemoryStore(), checkpointAt: 2}
+	bc, err := NewBlockChainWithOptions(BlockChainOptions{Store: store, CheckpointInterval: 2}, randBlock(t, 0, types.Hash{}))
+	assert.Nil(t, err)
+	assert.Nil(t, bc.AddBlock(nextBlock(t, bc)))
+
+	sub := bc.Subscribe(0)
+	defer sub.Unsubscribe()
+	b := nextBlock(t, bc)
+	assert.Nil(t, bc.AddBlock(b))
+	assert.Equal(t, uint32(2), bc.Height())
+	assert.Equal(t, b.StateRoot, bc.StateView().Root())
+	// the block was announced like any other
+	head := NewHeadEvent{}
+	for e := range sub.Events() {
+		if h, ok := e.(NewHeadEvent); ok {
+			head = h
+			break
+		}
+	}
+	assert.Equal(t, b, head.Block)
+}
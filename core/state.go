@@ -1,32 +1,176 @@
 package core
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"myblockchain/types"
+)
 
+var (
+	ErrReadOnlyState   = errors.New("state is read-only")
+	ErrUnknownSnapshot = errors.New("unknown snapshot")
+)
+
+// State holds its entries in the leaves of its sparse Merkle tree. The tree
+// is persistent, a write copies the path to its key and shares everything
+// else, so views, children and snapshots are a pointer to a root. State is
+// written by a single goroutine, other goroutines read from views of it,
+// see View.
 type State struct {
-	data map[string][]byte
+	trie *stateNode
+	// storage indexes the keys of contract storage in order
+	storage  *keyIndex
+	parent   *State
+	readOnly bool
+	// while a snapshot is taken the journal records what every write
+	// replaced, for the receipts and state diffs.
+	journal   []stateChange
+	snapshots []stateSnapshot
+}
+
+// stateSnapshot is the tree and index a snapshot was taken of and the
+// length of the journal at the time.
+type stateSnapshot struct {
+	trie    *stateNode
+	storage *keyIndex
+	journal int
 }
 
 func NewState() *State {
-	return &State{
-		data: make(map[string][]byte),
-	}
+	return &State{}
+}
+
+// Child returns a state that starts out with the entries of s but keeps
+// its own writes until Commit is called. s must not be written while the
+// child is in use.
+func (s *State) Child() *State {
+	return &State{trie: s.trie, storage: s.storage, parent: s}
+}
+
+// View returns a read-only copy of the state which later writes to s do not
+// change. It shares the tree of s, so it costs nothing to take and writes
+// only copy the paths they touch. View must be called by the goroutine
+// writing the state, the view can be read from any goroutine.
+func (s *State) View() *State {
+	return &State{trie: s.trie, storage: s.storage, readOnly: true}
 }
 
 func (s *State) Put(key, value []byte) error {
-	s.data[string(key)] = value
+	if s.readOnly {
+		return ErrReadOnlyState
+	}
+	s.record(string(key))
+	s.trie = s.trie.insert(newLeafNode(key, value), 0)
+	if isStorageKey(string(key)) {
+		s.storage = s.storage.insert(string(key))
+	}
 	return nil
 }
 
 func (s *State) Delete(key string) error {
-	delete(s.data, string(key))
+	if s.readOnly {
+		return ErrReadOnlyState
+	}
+	s.record(key)
+	s.trie = s.trie.remove(sha256.Sum256([]byte(key)), 0)
+	if isStorageKey(key) {
+		s.storage = s.storage.remove(key)
+	}
+	return nil
+}
+
+func (s *State) record(key string) {
+	if len(s.snapshots) > 0 {
+		s.journal = append(s.journal, s.change(key))
+	}
+}
+
+// Snapshot returns the id of a snapshot of the state, writes made after it
+// can be undone with RevertToSnapshot or kept with DiscardSnapshot.
+// Snapshots nest.
+func (s *State) Snapshot() int {
+	s.snapshots = append(s.snapshots, stateSnapshot{trie: s.trie, storage: s.storage, journal: len(s.journal)})
+	return len(s.snapshots) - 1
+}
+
+// RevertToSnapshot undoes every write made since the snapshot was taken,
+// the snapshot and those taken after it are gone afterwards.
+func (s *State) RevertToSnapshot(id int) error {
+	if id < 0 || id >= len(s.snapshots) {
+		return fmt.Errorf("%w: (%d)", ErrUnknownSnapshot, id)
+	}
+	snapshot := s.snapshots[id]
+	s.trie, s.storage = snapshot.trie, snapshot.storage
+	s.journal = s.journal[:snapshot.journal]
+	s.snapshots = s.snapshots[:id]
+	return nil
+}
+
+// DiscardSnapshot keeps every write made since the snapshot was taken and
+// forgets the snapshot and those taken after it. Once no snapshot is left
+// the journal is dropped, writes are only recorded while one is taken.
+func (s *State) DiscardSnapshot(id int) error {
+	if id < 0 || id >= len(s.snapshots) {
+		return fmt.Errorf("%w: (%d)", ErrUnknownSnapshot, id)
+	}
+	s.snapshots = s.snapshots[:id]
+	if len(s.snapshots) == 0 {
+		s.journal = nil
+	}
 	return nil
 }
 
 func (s *State) Get(k []byte) ([]byte, error) {
-	key := string(k)
-	value, ok := s.data[key]
-	if !ok {
-		return nil, fmt.Errorf("given key %s not found", key)
+	if leaf := s.trie.get(sha256.Sum256(k), 0); leaf != nil {
+		return leaf.value, nil
 	}
-	return value, nil
+	return nil, fmt.Errorf("given key %s not found", k)
+}
+
+// stateChange records the value a key had before it was written.
+type stateChange struct {
+	key     string
+	prev    []byte
+	existed bool
+}
+
+// Commit makes the writes of a child state part of its parent, the
+// snapshots of the child are dropped. The writes of a state without a
+// parent are its own already.
+func (s *State) Commit() {
+	if s.parent != nil {
+		s.parent.trie, s.parent.storage = s.trie, s.storage
+	}
+	s.journal, s.snapshots = nil, nil
+}
+
+func (s *State) change(key string) stateChange {
+	prev, err := s.Get([]byte(key))
+	return stateChange{key: key, prev: prev, existed: err == nil}
+}
+
+// entries returns every key and value of the state.
+func (s *State) entries() map[string][]byte {
+	entries := make(map[string][]byte)
+	s.trie.walk(func(n *stateNode) {
+		entries[n.key] = n.value
+	})
+	return entries
+}
+
+// Root returns the root of the sparse Merkle tree over all entries of the
+// state, which is what block headers commit to.
+func (s *State) Root() types.Hash {
+	return s.trie.root()
+}
+
+// Prove returns the proof of the value of the key, or that it is not set,
+// against the root of the state.
+func (s *State) Prove(key []byte) *StateProof {
+	proof := &StateProof{Key: key}
+	value, err := s.Get(key)
+	proof.Value, proof.Exists = value, err == nil
+	s.trie.prove(sha256.Sum256(key), 0, proof)
+	return proof
 }
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"myblockchain/types"
+	"sort"
+)
+
+type ChangeKind byte
+
+const (
+	KeyCreated  ChangeKind = 0x0
+	KeyModified ChangeKind = 0x1
+	KeyDeleted  ChangeKind = 0x2
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case KeyCreated:
+		return "created"
+	case KeyModified:
+		return "modified"
+	}
+	return "deleted"
+}
+
+// KeyChange is what happened to a state key.
+type KeyChange struct {
+	Key  []byte
+	Kind ChangeKind
+	// Old is nil for a created key, New is nil for a deleted one.
+	Old []byte
+	New []byte
+}
+
+// TxDiff is what a transaction changed in the state, the nonce and fee it
+// paid included.
+type TxDiff struct {
+	TxHash  types.Hash
+	Changes []KeyChange
+}
+
+// StateDiff is what applying a block changed in the state, as a whole and
+// per transaction. Keys that ended up with the value they started with are
+// left out.
+type StateDiff struct {
+	BlockHash types.Hash
+	Height    uint32
+	// Changes includes the fees and the reward paid to the proposer.
+	Changes []KeyChange
+	Txs     []TxDiff
+}
+
+// diffSince returns the changes made since the snapshot was taken, sorted
+// by key.
+func (s *State) diffSince(snapshot int) []KeyChange {
+	seen := make(map[string]bool)
+	changes := []KeyChange{}
+	for _, c := range s.journal[s.snapshots[snapshot].journal:] {
+		if seen[c.key] {
+			continue
+		}
+		seen[c.key] = true
+		value, err := s.Get([]byte(c.key))
+		change := KeyChange{Key: []byte(c.key), Old: c.prev, New: value}
+		switch exists := err == nil; {
+		case !c.existed && exists:
+			change.Kind = KeyCreated
+		case c.existed && !exists:
+			change.Kind = KeyDeleted
+		case c.existed && !bytes.Equal(c.prev, value):
+			change.Kind = KeyModified
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return bytes.Compare(changes[i].Key, changes[j].Key) < 0
+	})
+	return changes
+}
+
+// genesisDiff returns the state of the genesis block as a diff creating
+// every key.
+func genesisDiff(genesis *Block, s *State) *StateDiff {
+	entries := s.entries()
+	diff := &StateDiff{
+		BlockHash: genesis.Hash(BlockHasher{}),
+		Changes:   make([]KeyChange, 0, len(entries)),
+	}
+	for key, value := range entries {
+		diff.Changes = append(diff.Changes, KeyChange{Key: []byte(key), Kind: KeyCreated, New: value})
+	}
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		return bytes.Compare(diff.Changes[i].Key, diff.Changes[j].Key) < 0
+	})
+	return diff
+}
+
+// GetStateDiff returns what the block at the given height changed in the
+// state.
+func (bc *BlockChain) GetStateDiff(height uint32) (*StateDiff, error) {
+	if height > bc.Height() {
+		return nil, fmt.Errorf("given height (%d) too high", height)
+	}
+	return bc.store.GetStateDiff(height)
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateDiff(t *testing.T) {
+	alice, bob, proposer := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	aliceKey := accountKey(alice.PublicKey().Address())
+	bobKey := accountKey(bob.PublicKey().Address())
+	proposerKey := accountKey(proposer.PublicKey().Address())
+
+	diff, err := bc.GetStateDiff(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []KeyChange{{Key: aliceKey, Kind: KeyCreated, New: (&Account{Balance: 100}).Bytes()}}, diff.Changes)
+
+	transfer := &Transaction{Type: TxTypeTransfer, ChainID: bc.ChainID(), To: bob.PublicKey().Address(), Value: 10, Fee: 1}
+	assert.Nil(t, transfer.Sign(alice))
+	// the call fails, only its fee and nonce show up
+	call := &Transaction{Type: TxTypeCall, ChainID: bc.ChainID(), Nonce: 1, To: bob.PublicKey().Address(), Fee: 1}
+	assert.Nil(t, call.Sign(alice))
+	b, err := bc.ProposeBlock(proposer, []*Transaction{transfer, call})
+	assert.Nil(t, err)
+	mustAdd(t, bc, b)
+
+	diff, err = bc.GetStateDiff(1)
+	assert.Nil(t, err)
+	assert.Equal(t, b.Hash(BlockHasher{}), diff.BlockHash)
+	assert.Equal(t, uint32(1), diff.Height)
+	assert.Len(t, diff.Txs, 2)
+	assert.Equal(t, transfer.Hash(TxHasher{}), diff.Txs[0].TxHash)
+	assert.ElementsMatch(t, []KeyChange{
+		{Key: aliceKey, Kind: KeyModified, Old: (&Account{Balance: 100}).Bytes(), New: (&Account{Balance: 89, Nonce: 1}).Bytes()},
+		{Key: bobKey, Kind: KeyCreated, New: (&Account{Balance: 10}).Bytes()},
+		{Key: proposerKey, Kind: KeyCreated, New: (&Account{Balance: 1}).Bytes()},
+	}, diff.Txs[0].Changes)
+	assert.ElementsMatch(t, []KeyChange{
+		{Key: aliceKey, Kind: KeyModified, Old: (&Account{Balance: 89, Nonce: 1}).Bytes(), New: (&Account{Balance: 88, Nonce: 2}).Bytes()},
+		{Key: proposerKey, Kind: KeyModified, Old: (&Account{Balance: 1}).Bytes(), New: (&Account{Balance: 2}).Bytes()},
+	}, diff.Txs[1].Changes)
+	assert.ElementsMatch(t, []KeyChange{
+		{Key: aliceKey, Kind: KeyModified, Old: (&Account{Balance: 100}).Bytes(), New: (&Account{Balance: 88, Nonce: 2}).Bytes()},
+		{Key: bobKey, Kind: KeyCreated, New: (&Account{Balance: 10}).Bytes()},
+		{Key: proposerKey, Kind: KeyCreated, New: (&Account{Balance: 2}).Bytes()},
+	}, diff.Changes)
+
+	_, err = bc.GetStateDiff(2)
+	assert.NotNil(t, err)
+}
+
+func TestStateDiffSince(t *testing.T) {
+	s := NewState()
+	assert.Nil(t, s.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, s.Put([]byte("b"), []byte("1")))
+	snapshot := s.Snapshot()
+	assert.Nil(t, s.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, s.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, s.Delete("b"))
+	assert.Nil(t, s.Put([]byte("c"), []byte("1")))
+	assert.Nil(t, s.Put([]byte("d"), []byte("1")))
+	assert.Nil(t, s.Delete("d"))
+
+	// a is back to where it started and d never existed before or after
+	assert.Equal(t, []KeyChange{
+		{Key: []byte("b"), Kind: KeyDeleted, Old: []byte("1")},
+		{Key: []byte("c"), Kind: KeyCreated, New: []byte("1")},
+	}, s.diffSince(snapshot))
+}
+
+func TestStateDiffIsPersisted(t *testing.T) {
+	dir := t.TempDir()
+	genesis := randBlock(t, 0, types.Hash{})
+	bc := newFileStoreChain(t, dir, genesis)
+	b := mustAdd(t, bc, blockWithCode(t, bc, storeCode("foo", 1)))
+	expected, err := bc.GetStateDiff(1)
+	assert.Nil(t, err)
+	// the nonce of the sender and the stored key
+	assert.Len(t, expected.Txs[0].Changes, 2)
+	assert.Equal(t, []byte("foo"), expected.Txs[0].Changes[1].Key)
+	assert.Nil(t, bc.Close())
+
+	bc = newFileStoreChain(t, dir, genesis)
+	diff, err := bc.GetStateDiff(1)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, diff)
+	assert.Nil(t, bc.Close())
+
+	// a store written before diffs were recorded gets them on open
+	for _, name := range []string{"diffs.dat", "diffs.idx"} {
+		assert.Nil(t, os.Remove(filepath.Join(dir, name)))
+	}
+	bc = newFileStoreChain(t, dir, genesis)
+	defer bc.Close()
+	diff, err = bc.GetStateDiff(1)
+	assert.Nil(t, err)
+	assert.Equal(t, b.Hash(BlockHasher{}), diff.BlockHash)
+	assert.Equal(t, expected, diff)
+}
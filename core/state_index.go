@@ -0,0 +1,101 @@
+package core
+
+import (
+	"hash/maphash"
+	"strings"
+)
+
+// indexSeed makes the priorities of the index unknown outside of the node,
+// so nobody can pick keys that leave it unbalanced.
+var indexSeed = maphash.MakeSeed()
+
+// keyIndex is a persistent treap over keys, kept in order next to the tree
+// of the state so the keys under a prefix can be listed without walking
+// the whole state. Like the tree, nodes are never changed once made.
+type keyIndex struct {
+	key         string
+	priority    uint64
+	left, right *keyIndex
+}
+
+// insert returns the index with the key added.
+func (n *keyIndex) insert(key string) *keyIndex {
+	if n == nil {
+		return &keyIndex{key: key, priority: maphash.String(indexSeed, key)}
+	}
+	if key == n.key {
+		return n
+	}
+	c := *n
+	if key < n.key {
+		c.left = n.left.insert(key)
+		if c.left.priority > c.priority {
+			l := *c.left
+			c.left, l.right = l.right, &c
+			return &l
+		}
+		return &c
+	}
+	c.right = n.right.insert(key)
+	if c.right.priority > c.priority {
+		r := *c.right
+		c.right, r.left = r.left, &c
+		return &r
+	}
+	return &c
+}
+
+// remove returns the index without the key.
+func (n *keyIndex) remove(key string) *keyIndex {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	switch {
+	case key < n.key:
+		if c.left = n.left.remove(key); c.left == n.left {
+			return n
+		}
+	case key > n.key:
+		if c.right = n.right.remove(key); c.right == n.right {
+			return n
+		}
+	default:
+		return mergeIndex(n.left, n.right)
+	}
+	return &c
+}
+
+// mergeIndex joins two indexes whose keys are all lower in a than in b.
+func mergeIndex(a, b *keyIndex) *keyIndex {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		c := *a
+		c.right = mergeIndex(a.right, b)
+		return &c
+	}
+	c := *b
+	c.left = mergeIndex(a, b.left)
+	return &c
+}
+
+// scan calls fn in order for every key that starts with the prefix, only
+// visiting the parts of the index the prefix can be in.
+func (n *keyIndex) scan(prefix string, fn func(key string)) {
+	if n == nil {
+		return
+	}
+	if n.key >= prefix {
+		n.left.scan(prefix, fn)
+	}
+	if strings.HasPrefix(n.key, prefix) {
+		fn(n.key)
+	}
+	if n.key < prefix || strings.HasPrefix(n.key, prefix) {
+		n.right.scan(prefix, fn)
+	}
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkIndex asserts that the index is ordered by key and by priority and
+// returns its keys in order.
+func checkIndex(t *testing.T, n *keyIndex) []string {
+	if n == nil {
+		return nil
+	}
+	for _, child := range []*keyIndex{n.left, n.right} {
+		if child != nil {
+			assert.LessOrEqual(t, child.priority, n.priority)
+		}
+	}
+	left, right := checkIndex(t, n.left), checkIndex(t, n.right)
+	for _, key := range left {
+		assert.Less(t, key, n.key)
+	}
+	for _, key := range right {
+		assert.Greater(t, key, n.key)
+	}
+	return append(append(left, n.key), right...)
+}
+
+func TestKeyIndex(t *testing.T) {
+	var index *keyIndex
+	keys := map[string]bool{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("%c/%d", 'a'+rnd.Intn(4), rnd.Intn(200))
+		if rnd.Intn(3) == 0 {
+			index = index.remove(key)
+			delete(keys, key)
+		} else {
+			index = index.insert(key)
+			keys[key] = true
+		}
+	}
+	expected := []string{}
+	for key := range keys {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+	assert.Equal(t, expected, checkIndex(t, index))
+
+	for _, prefix := range []string{"", "a/", "b/1", "c/199", "d/5", "e/"} {
+		scanned := []string{}
+		index.scan(prefix, func(key string) { scanned = append(scanned, key) })
+		matching := []string{}
+		for _, key := range expected {
+			if strings.HasPrefix(key, prefix) {
+				matching = append(matching, key)
+			}
+		}
+		assert.Equal(t, matching, scanned, prefix)
+	}
+
+	// an older version is not changed by later writes
+	before := index
+	index = index.insert("z").remove(expected[0])
+	assert.Equal(t, expected, checkIndex(t, before))
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateChildCommit(t *testing.T) {
+	s := NewState()
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar")))
+
+	child := s.Child()
+	assert.Nil(t, child.Put([]byte("baz"), []byte("qux")))
+	assert.Nil(t, child.Delete("foo"))
+	_, err := child.Get([]byte("foo"))
+	assert.NotNil(t, err)
+	_, err = s.Get([]byte("baz"))
+	assert.NotNil(t, err)
+
+	before := s.View()
+	child.Commit()
+	_, err = s.Get([]byte("foo"))
+	assert.NotNil(t, err)
+	value, err := s.Get([]byte("baz"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("qux"), value)
+
+	// a view taken before the commit still holds the old entries
+	value, err = before.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bar"), value)
+	_, err = before.Get([]byte("baz"))
+	assert.NotNil(t, err)
+
+	// a state without a parent keeps its writes
+	s.Snapshot()
+	assert.Nil(t, s.Put([]byte("quux"), []byte("corge")))
+	s.Commit()
+	value, err = s.Get([]byte("quux"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("corge"), value)
+	assert.Empty(t, s.snapshots)
+}
+
+func TestStateSnapshots(t *testing.T) {
+	assertValue := func(s *State, key, value string) {
+		v, err := s.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(v))
+	}
+	s := NewState()
+	assert.Nil(t, s.Put([]byte("foo"), []byte("1")))
+	assert.Empty(t, s.journal)
+
+	outer := s.Snapshot()
+	assert.Nil(t, s.Put([]byte("foo"), []byte("2")))
+	assert.Nil(t, s.Put([]byte("bar"), []byte("1")))
+	inner := s.Snapshot()
+	assert.Nil(t, s.Delete("foo"))
+	assert.Nil(t, s.Put([]byte("baz"), []byte("1")))
+	assert.Equal(t, [][]byte{[]byte("baz"), []byte("foo")}, s.writtenKeys(inner))
+
+	assert.Nil(t, s.RevertToSnapshot(inner))
+	assertValue(s, "foo", "2")
+	assertValue(s, "bar", "1")
+	_, err := s.Get([]byte("baz"))
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, s.RevertToSnapshot(inner), ErrUnknownSnapshot)
+	assert.ErrorIs(t, s.RevertToSnapshot(-1), ErrUnknownSnapshot)
+
+	assert.Nil(t, s.RevertToSnapshot(outer))
+	assertValue(s, "foo", "1")
+	_, err = s.Get([]byte("bar"))
+	assert.NotNil(t, err)
+
+	// a child reverts its own writes only and forgets its snapshots on commit
+	child := s.Child()
+	snapshot := child.Snapshot()
+	assert.Nil(t, child.Delete("foo"))
+	assert.Nil(t, child.RevertToSnapshot(snapshot))
+	assertValue(child, "foo", "1")
+	child.Snapshot()
+	assert.Nil(t, child.Put([]byte("foo"), []byte("3")))
+	child.Commit()
+	assert.Empty(t, child.journal)
+	assert.ErrorIs(t, child.RevertToSnapshot(0), ErrUnknownSnapshot)
+	assertValue(s, "foo", "3")
+}
+
+func TestStateDiscardSnapshot(t *testing.T) {
+	s := NewState()
+	outer := s.Snapshot()
+	assert.Nil(t, s.Put([]byte("foo"), []byte("1")))
+	inner := s.Snapshot()
+	assert.Nil(t, s.Put([]byte("bar"), []byte("1")))
+
+	// the writes of a discarded inner snapshot can still be reverted by
+	// the outer one
+	assert.Nil(t, s.DiscardSnapshot(inner))
+	assert.ErrorIs(t, s.RevertToSnapshot(inner), ErrUnknownSnapshot)
+	assert.Len(t, s.journal, 2)
+	assert.Nil(t, s.RevertToSnapshot(outer))
+	_, err := s.Get([]byte("bar"))
+	assert.NotNil(t, err)
+
+	// discarding the last snapshot drops the journal and keeps the writes
+	outer = s.Snapshot()
+	assert.Nil(t, s.Put([]byte("foo"), []byte("2")))
+	assert.Nil(t, s.DiscardSnapshot(outer))
+	assert.Empty(t, s.journal)
+	assert.Empty(t, s.snapshots)
+	value, err := s.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), value)
+	assert.Nil(t, s.Put([]byte("baz"), []byte("1")))
+	assert.Empty(t, s.journal)
+	assert.ErrorIs(t, s.DiscardSnapshot(outer), ErrUnknownSnapshot)
+}
+
+func TestStateView(t *testing.T) {
+	s := NewState()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, s.Put([]byte{byte(i)}, []byte{byte(i)}))
+	}
+	root := s.Root()
+	view := s.View()
+	assert.ErrorIs(t, view.Put([]byte("foo"), []byte("bar")), ErrReadOnlyState)
+	assert.ErrorIs(t, view.Delete("foo"), ErrReadOnlyState)
+
+	assert.Nil(t, s.Put([]byte{0}, []byte("changed")))
+	assert.Nil(t, s.Delete(string([]byte{1})))
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar")))
+	value, err := view.Get([]byte{0})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0}, value)
+	value, err = view.Get([]byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1}, value)
+	_, err = view.Get([]byte("foo"))
+	assert.NotNil(t, err)
+	assert.Equal(t, root, view.Root())
+
+	later := s.View()
+	assert.Equal(t, s.Root(), later.Root())
+	assert.NotEqual(t, root, later.Root())
+}
+
+// stateAllocs returns the bytes allocated to take a view of a state of the
+// given size and then write to it as a block would.
+func stateAllocs(t *testing.T, size int) uint64 {
+	s := NewState()
+	for i := 0; i < size; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprint(i)), []byte{byte(i)}))
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for round := 0; round < 100; round++ {
+		s.View()
+		for i := 0; i < 10; i++ {
+			s.Put([]byte(fmt.Sprint(round*10+i)), []byte("changed"))
+		}
+	}
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestViewCopiesOnlyTouchedPaths(t *testing.T) {
+	small, large := stateAllocs(t, 1000), stateAllocs(t, 50000)
+	// fifty times the entries only makes the paths a few levels longer
+	assert.Less(t, large, 2*small)
+}
+
+func BenchmarkBlockState(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			s := NewState()
+			for i := 0; i < size; i++ {
+				s.Put([]byte(fmt.Sprint(i)), []byte{byte(i)})
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				// a block executes in a child, is committed and published
+				child := s.Child()
+				for i := 0; i < 10; i++ {
+					child.Put([]byte(fmt.Sprint((n*10+i)%size)), []byte("changed"))
+				}
+				child.Commit()
+				s.View().Root()
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"crypto/sha256"
+	"myblockchain/types"
+)
+
+// The state is committed to by a sparse Merkle tree over the sha256 of its
+// keys. An empty subtree hashes to the zero hash and a subtree holding a
+// single entry hashes to the leaf of that entry, so a path is only as long
+// as it needs to be to tell the keys apart.
+
+// StateLeaf is an entry of the state as the tree sees it.
+type StateLeaf struct {
+	Path      types.Hash
+	ValueHash types.Hash
+}
+
+func newStateLeaf(key, value []byte) StateLeaf {
+	return StateLeaf{Path: sha256.Sum256(key), ValueHash: sha256.Sum256(value)}
+}
+
+func (l StateLeaf) hash() types.Hash {
+	buf := make([]byte, 1+2*len(l.Path))
+	buf[0] = merkleLeafPrefix
+	copy(buf[1:], l.Path[:])
+	copy(buf[1+len(l.Path):], l.ValueHash[:])
+	return sha256.Sum256(buf)
+}
+
+func trieNode(left, right types.Hash) types.Hash {
+	if left.IsZero() && right.IsZero() {
+		return types.Hash{}
+	}
+	return merkleNode(left, right)
+}
+
+func pathBit(path types.Hash, depth int) byte {
+	return (path[depth/8] >> (7 - depth%8)) & 1
+}
+
+func samePrefix(a, b types.Hash, depth int) bool {
+	for i := 0; i < depth; i++ {
+		if pathBit(a, i) != pathBit(b, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// stateNode is a node of the tree. Nodes are never changed once made, an
+// update copies the nodes on the path to the key and shares all others, so
+// it costs as many hashes as the path is long. A leaf node has leaf set and
+// holds the entry, a branch has at least two leaves below it.
+type stateNode struct {
+	hash        types.Hash
+	leaf        *StateLeaf
+	key         string
+	value       []byte
+	left, right *stateNode
+}
+
+func (n *stateNode) root() types.Hash {
+	if n == nil {
+		return types.Hash{}
+	}
+	return n.hash
+}
+
+func newLeafNode(key, value []byte) *stateNode {
+	l := newStateLeaf(key, value)
+	return &stateNode{hash: l.hash(), leaf: &l, key: string(key), value: value}
+}
+
+func newBranchNode(left, right *stateNode) *stateNode {
+	return &stateNode{hash: trieNode(left.root(), right.root()), left: left, right: right}
+}
+
+// branchAt returns the branch at the given depth with child on the side
+// the path goes to and other on the other side.
+func branchAt(path types.Hash, depth int, child, other *stateNode) *stateNode {
+	if pathBit(path, depth) == 0 {
+		return newBranchNode(child, other)
+	}
+	return newBranchNode(other, child)
+}
+
+// insert returns the tree with the leaf node set, replacing the leaf of the
+// same path.
+func (n *stateNode) insert(leaf *stateNode, depth int) *stateNode {
+	path := leaf.leaf.Path
+	switch {
+	case n == nil:
+		return leaf
+	case n.leaf != nil && n.leaf.Path == path:
+		return leaf
+	case n.leaf != nil:
+		// the paths share the branches down to where they part
+		if pathBit(n.leaf.Path, depth) == pathBit(path, depth) {
+			return branchAt(path, depth, n.insert(leaf, depth+1), nil)
+		}
+		return branchAt(path, depth, leaf, n)
+	}
+	if pathBit(path, depth) == 0 {
+		return newBranchNode(n.left.insert(leaf, depth+1), n.right)
+	}
+	return newBranchNode(n.left, n.right.insert(leaf, depth+1))
+}
+
+// remove returns the tree without the leaf of the path. A branch left with
+// a single leaf below it is replaced by that leaf.
+func (n *stateNode) remove(path types.Hash, depth int) *stateNode {
+	switch {
+	case n == nil:
+		return nil
+	case n.leaf != nil:
+		if n.leaf.Path == path {
+			return nil
+		}
+		return n
+	}
+	left, right := n.left, n.right
+	if pathBit(path, depth) == 0 {
+		left = left.remove(path, depth+1)
+		if left == n.left {
+			return n
+		}
+	} else {
+		right = right.remove(path, depth+1)
+		if right == n.right {
+			return n
+		}
+	}
+	switch {
+	case left == nil && right != nil && right.leaf != nil:
+		return right
+	case right == nil && left != nil && left.leaf != nil:
+		return left
+	}
+	return newBranchNode(left, right)
+}
+
+// get returns the leaf node of the path, nil if there is none.
+func (n *stateNode) get(path types.Hash, depth int) *stateNode {
+	for n != nil && n.leaf == nil {
+		if pathBit(path, depth) == 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+		depth++
+	}
+	if n == nil || n.leaf.Path != path {
+		return nil
+	}
+	return n
+}
+
+// walk calls fn for every leaf node of the tree.
+func (n *stateNode) walk(fn func(*stateNode)) {
+	switch {
+	case n == nil:
+	case n.leaf != nil:
+		fn(n)
+	default:
+		n.left.walk(fn)
+		n.right.walk(fn)
+	}
+}
+
+// prove fills in the siblings of the path and the leaf it ends on if that
+// leaf belongs to another key.
+func (n *stateNode) prove(path types.Hash, depth int, proof *StateProof) {
+	switch {
+	case n == nil:
+		return
+	case n.leaf != nil:
+		if n.leaf.Path != path {
+			other := *n.leaf
+			proof.Other = &other
+		}
+		return
+	}
+	if pathBit(path, depth) == 0 {
+		n.left.prove(path, depth+1, proof)
+		proof.Siblings = append(proof.Siblings, n.right.root())
+	} else {
+		n.right.prove(path, depth+1, proof)
+		proof.Siblings = append(proof.Siblings, n.left.root())
+	}
+}
+
+// StateProof proves the value of a key, or that the key is not set, against
+// a state root.
+type StateProof struct {
+	Key    []byte
+	Exists bool
+	Value  []byte
+	// Siblings are the hashes next to the path of the key, from the leaf up.
+	Siblings []types.Hash
+	// Other is the leaf the path of a key that is not set ends on, nil if
+	// it ends on an empty subtree.
+	Other *StateLeaf
+}
+
+// Verify reports whether the proof leads to the given root.
+func (p *StateProof) Verify(root types.Hash) bool {
+	path := types.Hash(sha256.Sum256(p.Key))
+	depth := len(p.Siblings)
+	if depth > len(path)*8 {
+		return false
+	}
+	var hash types.Hash
+	switch {
+	case p.Exists:
+		if p.Other != nil {
+			return false
+		}
+		hash = newStateLeaf(p.Key, p.Value).hash()
+	case p.Other != nil:
+		// the other leaf must sit where the key would be
+		if p.Other.Path == path || !samePrefix(p.Other.Path, path, depth) {
+			return false
+		}
+		hash = p.Other.hash()
+	}
+	for i, sibling := range p.Siblings {
+		if pathBit(path, depth-1-i) == 0 {
+			hash = trieNode(hash, sibling)
+		} else {
+			hash = trieNode(sibling, hash)
+		}
+	}
+	return hash == root
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateRoot(t *testing.T) {
+	a, b := NewState(), NewState()
+	assert.Equal(t, types.Hash{}, a.Root())
+	assert.Nil(t, a.Put([]byte("foo"), []byte("bar")))
+	assert.Equal(t, newStateLeaf([]byte("foo"), []byte("bar")).hash(), a.Root())
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, a.Put([]byte(fmt.Sprint(i)), []byte{byte(i)}))
+		assert.Nil(t, b.Put([]byte(fmt.Sprint(19-i)), []byte{byte(19 - i)}))
+	}
+	assert.Nil(t, b.Put([]byte("foo"), []byte("bar")))
+	assert.Equal(t, a.Root(), b.Root())
+
+	child := b.Child()
+	assert.Nil(t, child.Put([]byte("foo"), []byte("baz")))
+	assert.NotEqual(t, a.Root(), child.Root())
+	assert.Nil(t, child.Put([]byte("foo"), []byte("bar")))
+	assert.Equal(t, a.Root(), child.Root())
+	assert.Nil(t, child.Delete("foo"))
+	assert.NotEqual(t, a.Root(), child.Root())
+}
+
+func TestStateProof(t *testing.T) {
+	s := NewState()
+	assert.True(t, s.Prove([]byte("foo")).Verify(s.Root()))
+
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprint(i)), []byte{byte(i)}))
+	}
+	root := s.Root()
+	for i := 0; i < 50; i++ {
+		proof := s.Prove([]byte(fmt.Sprint(i)))
+		assert.True(t, proof.Exists)
+		assert.Equal(t, []byte{byte(i)}, proof.Value)
+		assert.True(t, proof.Verify(root), "key %d", i)
+
+		proof.Value = []byte{byte(i + 1)}
+		assert.False(t, proof.Verify(root))
+		proof.Value, proof.Exists = nil, false
+		assert.False(t, proof.Verify(root))
+	}
+
+	others := 0
+	for i := 50; i < 100; i++ {
+		proof := s.Prove([]byte(fmt.Sprint(i)))
+		assert.False(t, proof.Exists)
+		assert.True(t, proof.Verify(root), "key %d", i)
+		if proof.Other != nil {
+			others++
+			// the leaf of a key that is set does not prove another absent
+			proof.Key = []byte("0")
+			assert.False(t, proof.Verify(root))
+		}
+	}
+	assert.NotZero(t, others)
+
+	proof := s.Prove([]byte("1"))
+	proof.Siblings = proof.Siblings[1:]
+	assert.False(t, proof.Verify(root))
+}
+
+func TestGetStateProof(t *testing.T) {
+	alice := crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	mustAdd(t, bc, proposeBlock(t, bc, transferTx(t, bc, alice, crypto.GeneratePrivateKey(), 0, 10)))
+
+	proof, header, err := bc.GetStateProof(accountKey(alice.PublicKey().Address()))
+	assert.Nil(t, err)
+	assert.Equal(t, bc.Height(), header.Height)
+	assert.True(t, proof.Exists)
+	assert.Equal(t, (&Account{Balance: 90, Nonce: 1}).Bytes(), proof.Value)
+	assert.True(t, proof.Verify(header.StateRoot))
+
+	proof, header, err = bc.GetStateProof([]byte("missing"))
+	assert.Nil(t, err)
+	assert.False(t, proof.Exists)
+	assert.True(t, proof.Verify(header.StateRoot))
+}
+
+// rebuiltRoot computes the root of the entries from scratch, straight from
+// the definition of the tree.
+func rebuiltRoot(entries map[string][]byte) types.Hash {
+	leaves := []StateLeaf{}
+	for key, value := range entries {
+		leaves = append(leaves, newStateLeaf([]byte(key), value))
+	}
+	var root func(leaves []StateLeaf, depth int) types.Hash
+	root = func(leaves []StateLeaf, depth int) types.Hash {
+		switch len(leaves) {
+		case 0:
+			return types.Hash{}
+		case 1:
+			return leaves[0].hash()
+		}
+		left, right := []StateLeaf{}, []StateLeaf{}
+		for _, l := range leaves {
+			if pathBit(l.Path, depth) == 0 {
+				left = append(left, l)
+			} else {
+				right = append(right, l)
+			}
+		}
+		return trieNode(root(left, depth+1), root(right, depth+1))
+	}
+	return root(leaves, 0)
+}
+
+func TestStateTrieIsUpdatedIncrementally(t *testing.T) {
+	s := NewState()
+	entries := map[string][]byte{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprint(rnd.Intn(300))
+		if rnd.Intn(3) == 0 {
+			assert.Nil(t, s.Delete(key))
+			delete(entries, key)
+		} else {
+			value := []byte{byte(rnd.Intn(256))}
+			assert.Nil(t, s.Put([]byte(key), value))
+			entries[key] = value
+		}
+		if i%100 == 0 {
+			assert.Equal(t, rebuiltRoot(entries), s.Root(), "after %d writes", i)
+		}
+	}
+	assert.Equal(t, rebuiltRoot(entries), s.Root())
+	for key := range entries {
+		assert.True(t, s.Prove([]byte(key)).Verify(s.Root()))
+	}
+
+	// deleting everything collapses the tree back to empty
+	for key := range entries {
+		assert.Nil(t, s.Delete(key))
+	}
+	assert.Equal(t, types.Hash{}, s.Root())
+	assert.Nil(t, s.trie)
+}
+
+func TestStateRootAndProofDoNotWalkTheState(t *testing.T) {
+	s := NewState()
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprint(i)), []byte{byte(i)}))
+	}
+	assert.Zero(t, testing.AllocsPerRun(10, func() { s.Root() }))
+	// a proof allocates per level of the tree, not per entry
+	allocs := testing.AllocsPerRun(10, func() { s.Prove([]byte("42")) })
+	assert.Less(t, allocs, float64(64))
+}
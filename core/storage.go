@@ -1,16 +1,252 @@
 package core
 
+import (
+	"fmt"
+	"myblockchain/types"
+	"sort"
+	"sync"
+)
+
+// TxLocation tells in which block, and where inside of it, a transaction
+// was included.
+type TxLocation struct {
+	BlockHash types.Hash
+	Height    uint32
+	Index     uint32
+}
+
 type Storage interface {
 	Put(*Block) error
+	Get(height uint32) (*Block, error)
+	GetByHash(hash types.Hash) (*Block, error)
+	GetTx(hash types.Hash) (*Transaction, *TxLocation, error)
+	// Range calls fn for every block from height from up to and including
+	// height to, stopping at the first error.
+	Range(from, to uint32, fn func(*Block) error) error
+	// PutReceipts stores the receipts of the block at the given height,
+	// which has to be stored already.
+	PutReceipts(height uint32, receipts []*Receipt) error
+	GetReceipts(height uint32) ([]*Receipt, error)
+	// PutStateDiff stores what the block at the given height changed in the
+	// state, its receipts have to be stored already.
+	PutStateDiff(height uint32, diff *StateDiff) error
+	GetStateDiff(height uint32) (*StateDiff, error)
+	// PutStateCheckpoint stores every entry of the state after the block at
+	// the given height, whose state diff has to be stored already.
+	// Checkpoints are put in increasing order of height.
+	PutStateCheckpoint(height uint32, entries map[string][]byte) error
+	GetStateCheckpoint(height uint32) (map[string][]byte, error)
+	// StateCheckpointBelow returns the height of the last checkpoint at or
+	// below the given height.
+	StateCheckpointBelow(height uint32) (uint32, error)
+	// PruneStateCheckpoints removes the checkpoints below the given height.
+	PruneStateCheckpoints(height uint32) error
+	// Rewind removes every block, its receipts, state diff and checkpoint,
+	// above the given height.
+	Rewind(height uint32) error
+	// Len returns the number of blocks in the store.
+	Len() uint32
+	Close() error
 }
 
 type MemoryStore struct {
+	lock     sync.RWMutex
+	blocks   []*Block
+	receipts [][]*Receipt
+	diffs    []*StateDiff
+	hashes   map[types.Hash]uint32
+	txs      map[types.Hash]TxLocation
+
+	// checkpoints in increasing order of height
+	checkpoints []stateCheckpoint
 }
 
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{}
+	return &MemoryStore{
+		hashes: make(map[types.Hash]uint32),
+		txs:    make(map[types.Hash]TxLocation),
+	}
 }
 
 func (m *MemoryStore) Put(b *Block) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if int(b.Height) != len(m.blocks) {
+		return fmt.Errorf("cannot store block (%d), next height in store is (%d)", b.Height, len(m.blocks))
+	}
+	hash := b.Hash(BlockHasher{})
+	m.blocks = append(m.blocks, b)
+	m.hashes[hash] = b.Height
+	for i, tx := range b.Transactions {
+		m.txs[tx.Hash(TxHasher{})] = TxLocation{
+			BlockHash: hash,
+			Height:    b.Height,
+			Index:     uint32(i),
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Get(height uint32) (*Block, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if int(height) >= len(m.blocks) {
+		return nil, fmt.Errorf("block at height (%d) not found", height)
+	}
+	return m.blocks[height], nil
+}
+
+func (m *MemoryStore) GetByHash(hash types.Hash) (*Block, error) {
+	m.lock.RLock()
+	height, ok := m.hashes[hash]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("block with hash (%s) not found", hash)
+	}
+	return m.Get(height)
+}
+
+func (m *MemoryStore) GetTx(hash types.Hash) (*Transaction, *TxLocation, error) {
+	m.lock.RLock()
+	loc, ok := m.txs[hash]
+	m.lock.RUnlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("could not find tx with hash (%s)", hash)
+	}
+	b, err := m.Get(loc.Height)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b.Transactions[loc.Index], &loc, nil
+}
+
+func (m *MemoryStore) Range(from, to uint32, fn func(*Block) error) error {
+	for height := from; height <= to; height++ {
+		b, err := m.Get(height)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) PutReceipts(height uint32, receipts []*Receipt) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if int(height) != len(m.receipts) || int(height) >= len(m.blocks) {
+		return fmt.Errorf("cannot store receipts of block (%d)", height)
+	}
+	m.receipts = append(m.receipts, receipts)
+	return nil
+}
+
+func (m *MemoryStore) GetReceipts(height uint32) ([]*Receipt, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if int(height) >= len(m.receipts) {
+		return nil, fmt.Errorf("receipts of block (%d) not found", height)
+	}
+	return m.receipts[height], nil
+}
+
+func (m *MemoryStore) PutStateDiff(height uint32, diff *StateDiff) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if int(height) != len(m.diffs) || int(height) >= len(m.receipts) {
+		return fmt.Errorf("cannot store state diff of block (%d)", height)
+	}
+	m.diffs = append(m.diffs, diff)
+	return nil
+}
+
+func (m *MemoryStore) GetStateDiff(height uint32) (*StateDiff, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if int(height) >= len(m.diffs) {
+		return nil, fmt.Errorf("state diff of block (%d) not found", height)
+	}
+	return m.diffs[height], nil
+}
+
+// stateCheckpoint is every entry of the state after the block at a height.
+type stateCheckpoint struct {
+	Height  uint32
+	Entries map[string][]byte
+}
+
+func (m *MemoryStore) PutStateCheckpoint(height uint32, entries map[string][]byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if int(height) >= len(m.diffs) || (len(m.checkpoints) > 0 && height <= m.checkpoints[len(m.checkpoints)-1].Height) {
+		return fmt.Errorf("cannot store state checkpoint of block (%d)", height)
+	}
+	m.checkpoints = append(m.checkpoints, stateCheckpoint{Height: height, Entries: entries})
+	return nil
+}
+
+func (m *MemoryStore) GetStateCheckpoint(height uint32) (map[string][]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	n := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].Height >= height })
+	if n == len(m.checkpoints) || m.checkpoints[n].Height != height {
+		return nil, fmt.Errorf("state checkpoint of block (%d) not found", height)
+	}
+	return m.checkpoints[n].Entries, nil
+}
+
+func (m *MemoryStore) StateCheckpointBelow(height uint32) (uint32, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	n := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].Height > height })
+	if n == 0 {
+		return 0, fmt.Errorf("no state checkpoint at or below height (%d)", height)
+	}
+	return m.checkpoints[n-1].Height, nil
+}
+
+func (m *MemoryStore) PruneStateCheckpoints(height uint32) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].Height >= height })
+	m.checkpoints = append([]stateCheckpoint(nil), m.checkpoints[n:]...)
+	return nil
+}
+
+func (m *MemoryStore) Rewind(height uint32) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if int(height) >= len(m.blocks) {
+		return fmt.Errorf("cannot rewind to height (%d), store height is (%d)", height, len(m.blocks)-1)
+	}
+	for _, b := range m.blocks[height+1:] {
+		delete(m.hashes, b.Hash(BlockHasher{}))
+		for _, tx := range b.Transactions {
+			if m.txs[tx.Hash(TxHasher{})].Height == b.Height {
+				delete(m.txs, tx.Hash(TxHasher{}))
+			}
+		}
+	}
+	m.blocks = m.blocks[:height+1]
+	if len(m.receipts) > len(m.blocks) {
+		m.receipts = m.receipts[:len(m.blocks)]
+	}
+	if len(m.diffs) > len(m.blocks) {
+		m.diffs = m.diffs[:len(m.blocks)]
+	}
+	n := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].Height > height })
+	m.checkpoints = m.checkpoints[:n]
+	return nil
+}
+
+func (m *MemoryStore) Len() uint32 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return uint32(len(m.blocks))
+}
+
+func (m *MemoryStore) Close() error {
 	return nil
 }
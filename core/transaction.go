@@ -1,18 +1,40 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"myblockchain/crypto"
 	"myblockchain/types"
 )
 
+var (
+	ErrWrongChain = errors.New("transaction is for another chain")
+	ErrTxExpired  = errors.New("transaction expired")
+)
+
 type Transaction struct {
-	Data      []byte
-	From      crypto.PublicKey
-	Signature *crypto.Signature
+	Type TxType
+	// ChainID is the chain the transaction is meant for, it cannot be
+	// replayed on another one.
+	ChainID uint32
+	// Nonce tells apart transactions of the same sender.
+	Nonce uint64
+	To    types.Address
+	Value uint64
+	// Fee is what the sender pays for the transaction to be included.
+	Fee uint64
+	// ValidUntilHeight and ValidUntilTime, in unix nanoseconds like the
+	// timestamp of a header, are the last block height and time the
+	// transaction can be included at. Zero means no limit.
+	ValidUntilHeight uint32
+	ValidUntilTime   uint64
+	Data             []byte
+	From             crypto.PublicKey
+	Signature        *crypto.Signature
 
 	hash types.Hash
-	// firstSeen int64
+	// when the local node first saw the transaction, not encoded
+	firstSeen int64
 }
 
 func NewTransaction(data []byte) *Transaction {
@@ -28,21 +50,27 @@ func (tx *Transaction) Hash(hasher Hasher[*Transaction]) types.Hash {
 	return tx.hash
 }
 
+// Sign signs all fields of the transaction, the sender included.
 func (tx *Transaction) Sign(priv crypto.PrivateKey) error {
-	sig, err := priv.Sign(tx.Data)
+	tx.From = priv.PublicKey()
+	tx.hash = types.Hash{}
+	sig, err := priv.Sign(encodeTxPayload(tx))
 	if err != nil {
 		return err
 	}
-	tx.From = priv.PublicKey()
 	tx.Signature = sig
 	return nil
 }
 
+// Verify checks the fields and the signature of the transaction.
 func (tx *Transaction) Verify() error {
+	if err := tx.Validate(); err != nil {
+		return err
+	}
 	if tx.Signature == nil {
 		return fmt.Errorf("Transaction is not signed")
 	}
-	if !tx.Signature.Verify(tx.Data, tx.From) {
+	if !tx.Signature.Verify(encodeTxPayload(tx), tx.From) {
 		return fmt.Errorf("Transaction signature is invalid")
 	}
 	return nil
@@ -56,10 +84,17 @@ func (tx *Transaction) Encode(enc Encoder[*Transaction]) error {
 	return enc.Encode(tx)
 }
 
-// func (tx *Transaction) SetFirstSeen(t int64) {
-// 	tx.firstSeen = t
-// }
+// Expired reports whether the transaction can no longer be included in a
+// block with the given height and timestamp.
+func (tx *Transaction) Expired(height uint32, timestamp uint64) bool {
+	return (tx.ValidUntilHeight != 0 && height > tx.ValidUntilHeight) ||
+		(tx.ValidUntilTime != 0 && timestamp > tx.ValidUntilTime)
+}
 
-// func (tx *Transaction) FirstSeen() int64 {
-// 	return tx.firstSeen
-// }
+func (tx *Transaction) SetFirstSeen(t int64) {
+	tx.firstSeen = t
+}
+
+func (tx *Transaction) FirstSeen() int64 {
+	return tx.firstSeen
+}
@@ -44,3 +44,87 @@ func randomTxWithSignature(t *testing.T) *Transaction {
 	assert.Nil(t, tx.Sign(privKey))
 	return &tx
 }
+
+func TestTxHashCoversAllFields(t *testing.T) {
+	privKey := crypto.GeneratePrivateKey()
+	to := crypto.GeneratePrivateKey().PublicKey().Address()
+	tx := &Transaction{Type: TxTypeCall, ChainID: 1, Nonce: 1, To: to, Value: 10, Fee: 1, Data: []byte("foo")}
+	assert.Nil(t, tx.Sign(privKey))
+	hash := tx.Hash(TxHasher{})
+
+	// the same data sent by someone else is another transaction
+	other := &Transaction{Type: TxTypeCall, ChainID: 1, Nonce: 1, To: to, Value: 10, Fee: 1, Data: []byte("foo")}
+	assert.Nil(t, other.Sign(crypto.GeneratePrivateKey()))
+	assert.NotEqual(t, hash, other.Hash(TxHasher{}))
+
+	for _, change := range []func(*Transaction){
+		func(tx *Transaction) { tx.Type = TxTypeTransfer },
+		func(tx *Transaction) { tx.ChainID++ },
+		func(tx *Transaction) { tx.Nonce++ },
+		func(tx *Transaction) { tx.To = privKey.PublicKey().Address() },
+		func(tx *Transaction) { tx.Value++ },
+		func(tx *Transaction) { tx.Fee++ },
+		func(tx *Transaction) { tx.Data = []byte("bar") },
+	} {
+		changed := *tx
+		change(&changed)
+		assert.NotEqual(t, hash, TxHasher{}.Hash(&changed))
+		assert.NotNil(t, changed.Verify())
+	}
+
+	// signing again must not keep the hash of the old content
+	tx.Nonce++
+	assert.Nil(t, tx.Sign(privKey))
+	assert.NotEqual(t, hash, tx.Hash(TxHasher{}))
+	assert.Nil(t, tx.Verify())
+}
+
+func TestBlockRejectsTxOfOtherChain(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	tx := NewTransaction([]byte("foo"))
+	tx.ChainID = bc.ChainID() + 1
+	assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+	assert.ErrorIs(t, bc.AddBlock(proposeBlock(t, bc, tx)), ErrWrongChain)
+}
+
+func TestTxExpiry(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	tx := &Transaction{Data: storeCode("a", 1), ValidUntilHeight: 1}
+	assert.False(t, tx.Expired(1, 0))
+	assert.True(t, tx.Expired(2, 0))
+	tx.ValidUntilTime = 10
+	assert.False(t, tx.Expired(1, 10))
+	assert.True(t, tx.Expired(1, 11))
+
+	expired := &Transaction{Data: storeCode("b", 1), ValidUntilTime: 1}
+	assert.Nil(t, expired.Sign(crypto.GeneratePrivateKey()))
+	b := mustAdd(t, bc, proposeBlock(t, bc, expired))
+	assert.Len(t, b.Transactions, 0)
+
+	priv := crypto.GeneratePrivateKey()
+	tip, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+	b, err = NewBlockFromHeader(tip, []*Transaction{expired}, HeaderFields{Proposer: priv.PublicKey().Address()})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(priv))
+	assert.ErrorIs(t, bc.AddBlock(b), ErrTxExpired)
+}
+
+func TestReplayedTxIsRejected(t *testing.T) {
+	alice, bob := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	bc := newFundedChain(t, alice, 100)
+	tx := transferTx(t, bc, alice, bob, 0, 10)
+	mustAdd(t, bc, proposeBlock(t, bc, tx))
+
+	// the proposer leaves the replay out, a block carrying it is invalid
+	b := mustAdd(t, bc, proposeBlock(t, bc, tx))
+	assert.Len(t, b.Transactions, 0)
+
+	tip, err := bc.GetHeader(bc.Height())
+	assert.Nil(t, err)
+	b, err = NewBlockFromHeader(tip, []*Transaction{tx}, HeaderFields{Proposer: alice.PublicKey().Address()})
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(alice))
+	assert.ErrorIs(t, bc.AddBlock(b), ErrBadNonce)
+	assertAccount(t, bc, alice, 90, 1)
+}
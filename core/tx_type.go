@@ -0,0 +1,90 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"myblockchain/types"
+)
+
+// TxType tells how a transaction is executed. A new kind of transaction
+// gets its own type, a case in Validate and one in executeTx, nodes that
+// do not know a type reject its transactions.
+type TxType byte
+
+const (
+	// TxTypeScript runs Data as code against the shared state.
+	TxTypeScript TxType = 0x0
+	// TxTypeTransfer sends Value to To.
+	TxTypeTransfer TxType = 0x1
+	// TxTypeDeploy creates a contract with Data as its code.
+	TxTypeDeploy TxType = 0x2
+	// TxTypeCall runs the code of the contract at To with Data as input.
+	TxTypeCall TxType = 0x3
+)
+
+var ErrInvalidTx = errors.New("invalid transaction")
+
+func (t TxType) String() string {
+	switch t {
+	case TxTypeScript:
+		return "script"
+	case TxTypeTransfer:
+		return "transfer"
+	case TxTypeDeploy:
+		return "deploy"
+	case TxTypeCall:
+		return "call"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// Validate checks that the fields of the transaction make sense for its
+// type, without looking at any state.
+func (tx *Transaction) Validate() error {
+	var zero types.Address
+	switch tx.Type {
+	case TxTypeScript:
+		if tx.To != zero || tx.Value != 0 {
+			return fmt.Errorf("%w: script tx has a recipient or value", ErrInvalidTx)
+		}
+	case TxTypeTransfer:
+		if tx.To == zero {
+			return fmt.Errorf("%w: transfer without recipient", ErrInvalidTx)
+		}
+		if tx.Value == 0 {
+			return fmt.Errorf("%w: transfer without value", ErrInvalidTx)
+		}
+		if len(tx.Data) > 0 {
+			return fmt.Errorf("%w: transfer with data", ErrInvalidTx)
+		}
+	case TxTypeDeploy:
+		if tx.To != zero || tx.Value != 0 {
+			return fmt.Errorf("%w: deploy tx has a recipient or value", ErrInvalidTx)
+		}
+		if len(tx.Data) == 0 {
+			return fmt.Errorf("%w: deploy without code", ErrInvalidTx)
+		}
+	case TxTypeCall:
+		if tx.To == zero {
+			return fmt.Errorf("%w: call without contract", ErrInvalidTx)
+		}
+	default:
+		return fmt.Errorf("%w: unknown type (%d)", ErrInvalidTx, tx.Type)
+	}
+	return nil
+}
+
+// ContractAddress returns the address of the contract the sender deploys
+// with the given nonce.
+func ContractAddress(from types.Address, nonce uint64) types.Address {
+	buf := binary.BigEndian.AppendUint64(from.ToSlice(), nonce)
+	h := sha256.Sum256(buf)
+	return types.AddressFromBytes(h[len(h)-20:])
+}
+
+// codeKey is the state key the code of a contract is stored under.
+func codeKey(addr types.Address) []byte {
+	return append([]byte("code/"), addr[:]...)
+}
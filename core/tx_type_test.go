@@ -0,0 +1,69 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTxType(t *testing.T) {
+	to := crypto.GeneratePrivateKey().PublicKey().Address()
+	valid := []*Transaction{
+		{Type: TxTypeScript, Data: []byte{0x1}},
+		{Type: TxTypeTransfer, To: to, Value: 1},
+		{Type: TxTypeDeploy, Data: []byte{0x1}},
+		{Type: TxTypeCall, To: to},
+		{Type: TxTypeCall, To: to, Value: 1, Data: []byte("input")},
+	}
+	for _, tx := range valid {
+		assert.Nil(t, tx.Validate(), tx.Type.String())
+	}
+
+	invalid := []*Transaction{
+		{Type: TxTypeScript, To: to},
+		{Type: TxTypeScript, Value: 1},
+		{Type: TxTypeTransfer, Value: 1},
+		{Type: TxTypeTransfer, To: to},
+		{Type: TxTypeTransfer, To: to, Value: 1, Data: []byte{0x1}},
+		{Type: TxTypeDeploy},
+		{Type: TxTypeDeploy, To: to, Data: []byte{0x1}},
+		{Type: TxTypeCall},
+		{Type: 0x7f, To: to},
+	}
+	for _, tx := range invalid {
+		assert.ErrorIs(t, tx.Validate(), ErrInvalidTx, tx.Type.String())
+		assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+		assert.ErrorIs(t, tx.Verify(), ErrInvalidTx)
+	}
+}
+
+func TestDeployAndCallContract(t *testing.T) {
+	bc := NewBlockChainWithGenesis(t)
+	priv := crypto.GeneratePrivateKey()
+
+	// the contract stores 7 under the key it is called with
+	deploy := &Transaction{Type: TxTypeDeploy, Data: []byte{0x7, byte(InstrPushInt), byte(InstrStore)}}
+	assert.Nil(t, deploy.Sign(priv))
+	mustAdd(t, bc, proposeBlock(t, bc, deploy))
+	receipt, err := bc.GetReceipt(deploy.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptSuccess, receipt.Status)
+	addr := ContractAddress(priv.PublicKey().Address(), 0)
+	assert.Equal(t, addr.ToSlice(), receipt.Result)
+
+	call := &Transaction{Type: TxTypeCall, To: addr, Data: []byte("foo")}
+	assert.Nil(t, call.Sign(crypto.GeneratePrivateKey()))
+	missing := &Transaction{Type: TxTypeCall, To: types.Address{0x1}, Data: []byte("bar")}
+	assert.Nil(t, missing.Sign(crypto.GeneratePrivateKey()))
+	mustAdd(t, bc, proposeBlock(t, bc, call, missing))
+
+	// the contract stores into its own keyspace
+	assertStateValue(t, bc.contractState, string(storageKey(addr, []byte("foo"))), 7)
+	_, err = bc.contractState.Get([]byte("foo"))
+	assert.NotNil(t, err)
+	receipt, err = bc.GetReceipt(missing.Hash(TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptFailed, receipt.Status)
+}
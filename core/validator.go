@@ -3,12 +3,33 @@ package core
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 )
 
-var ErrBlockKnown = errors.New("block already known")
+var (
+	ErrBlockKnown    = errors.New("block already known")
+	ErrUnknownParent = errors.New("block parent unknown")
+	ErrNotValidator  = errors.New("block signer is not an authorized validator")
+	ErrStateRoot     = errors.New("block state root does not match its execution")
+	ErrReceiptsRoot  = errors.New("block receipts root does not match its execution")
+	ErrBlockLimit    = errors.New("block exceeds the limits of the chain")
+	ErrTimestamp     = errors.New("block timestamp too early")
+	// ErrFutureBlock is not final, the block may be valid once the local
+	// clock caught up.
+	ErrFutureBlock = errors.New("block timestamp too far in the future")
+)
+
+// MaxExtraSize bounds the extra data of a header.
+const MaxExtraSize = 32
+
+const defaultMaxFutureTime = 15 * time.Second
 
 type Validator interface {
 	ValidateBlock(b *Block) error
+	// ValidateExecution checks the block against the state and receipts
+	// that executing it produced.
+	ValidateExecution(b *Block, s *State, receipts []*Receipt) error
 }
 
 type BlockValidator struct {
@@ -20,22 +41,37 @@ func NewBlockValidator(bc *BlockChain) *BlockValidator {
 }
 
 func (v *BlockValidator) ValidateBlock(b *Block) error {
-	if v.bc.HasBlock(b.Height) {
+	if v.bc.HasBlockHash(b.Hash(BlockHasher{})) {
 		return ErrBlockKnown
 	}
-	if b.Height != v.bc.Height()+1 {
-		return fmt.Errorf("block height %d is not the next block in the chain", b.Height)
-	}
-	prevHeader, err := v.bc.GetHeader(b.Height - 1)
-
+	prevHeader, err := v.bc.GetHeaderByHash(b.PrevBlockHash)
 	if err != nil {
+		return fmt.Errorf("%w: block %d has prev block hash %s", ErrUnknownParent, b.Height, b.PrevBlockHash)
+	}
+	if b.Height != prevHeader.Height+1 {
+		return fmt.Errorf("block height %d is not the next block after its parent %d", b.Height, prevHeader.Height)
+	}
+	if b.ChainID != prevHeader.ChainID {
+		return fmt.Errorf("block %d has chain id %d, its parent %d", b.Height, b.ChainID, prevHeader.ChainID)
+	}
+	if len(b.Extra) > MaxExtraSize {
+		return fmt.Errorf("block %d extra data of %d bytes exceeds %d bytes", b.Height, len(b.Extra), MaxExtraSize)
+	}
+	if err := v.validateTimestamp(b, prevHeader); err != nil {
 		return err
 	}
+	if err := checkBlockLimits(v.bc.consensus(), b.Transactions); err != nil {
+		return fmt.Errorf("block %d: %w", b.Height, err)
+	}
+	if tip := v.bc.Height(); tip > v.bc.maxForkDepth && b.Height < tip-v.bc.maxForkDepth {
+		return fmt.Errorf("block %d forks off too deep below the tip %d", b.Height, tip)
+	}
 
-	hash := BlockHasher{}.Hash(prevHeader)
-
-	if hash != b.PrevBlockHash {
-		return fmt.Errorf("block %d has invalid prev block hash %d", b.Height, b.PrevBlockHash)
+	if !v.bc.IsValidator(b.Validatar.Address()) {
+		return fmt.Errorf("%w: %s", ErrNotValidator, b.Validatar.Address())
+	}
+	if b.Proposer != b.Validatar.Address() {
+		return fmt.Errorf("block %d proposer %s is not its signer %s", b.Height, b.Proposer, b.Validatar.Address())
 	}
 
 	if err := b.Verify(); err != nil {
@@ -43,3 +79,79 @@ func (v *BlockValidator) ValidateBlock(b *Block) error {
 	}
 	return nil
 }
+
+func (v *BlockValidator) ValidateExecution(b *Block, s *State, receipts []*Receipt) error {
+	if root := s.Root(); root != b.StateRoot {
+		return fmt.Errorf("%w: block %d has %s, execution gives %s", ErrStateRoot, b.Height, b.StateRoot, root)
+	}
+	if root := ReceiptsRoot(receipts); root != b.ReceiptsRoot {
+		return fmt.Errorf("%w: block %d has %s, execution gives %s", ErrReceiptsRoot, b.Height, b.ReceiptsRoot, root)
+	}
+	if max := v.bc.consensus().MaxBlockCost; max > 0 {
+		cost := uint64(0)
+		for _, r := range receipts {
+			cost += r.Cost
+		}
+		if cost > max {
+			return fmt.Errorf("%w: block %d costs %d, the limit is %d", ErrBlockLimit, b.Height, cost, max)
+		}
+	}
+	return nil
+}
+
+// validateTimestamp checks that the timestamp of the block is after the one
+// of its parent and not too far ahead of the local clock. Time has to
+// advance with every block, and get past the median of the previous blocks
+// if the chain asks for it.
+func (v *BlockValidator) validateTimestamp(b *Block, prevHeader *Header) error {
+	if b.Timestamp <= prevHeader.Timestamp {
+		return fmt.Errorf("%w: block %d has timestamp %d, its parent %d", ErrTimestamp, b.Height, b.Timestamp, prevHeader.Timestamp)
+	}
+	if max := v.bc.now().Add(v.bc.maxFutureTime); b.Timestamp > uint64(max.UnixNano()) {
+		return fmt.Errorf("%w: block %d has timestamp %d, the latest accepted is %d", ErrFutureBlock, b.Height, b.Timestamp, max.UnixNano())
+	}
+	if n := v.bc.consensus().MedianTimeBlocks; n > 0 {
+		median, err := v.bc.medianTime(prevHeader, n)
+		if err != nil {
+			return err
+		}
+		if b.Timestamp <= median {
+			return fmt.Errorf("%w: block %d has timestamp %d, the median of the previous blocks is %d", ErrTimestamp, b.Height, b.Timestamp, median)
+		}
+	}
+	return nil
+}
+
+// medianTime returns the median timestamp of the given header and the n-1
+// headers before it, fewer close to the genesis.
+func (bc *BlockChain) medianTime(h *Header, n uint32) (uint64, error) {
+	timestamps := []uint64{h.Timestamp}
+	for uint32(len(timestamps)) < n && h.Height > 0 {
+		prev, err := bc.GetHeaderByHash(h.PrevBlockHash)
+		if err != nil {
+			return 0, err
+		}
+		h = prev
+		timestamps = append(timestamps, h.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkBlockLimits checks the number and the size of the transactions of a
+// block against the consensus parameters.
+func checkBlockLimits(params ConsensusParams, txs []*Transaction) error {
+	if params.MaxBlockTxs > 0 && len(txs) > int(params.MaxBlockTxs) {
+		return fmt.Errorf("%w: %d transactions, the limit is %d", ErrBlockLimit, len(txs), params.MaxBlockTxs)
+	}
+	if params.MaxBlockBytes > 0 {
+		size := 0
+		for _, tx := range txs {
+			size += encodedTxSize(tx)
+		}
+		if size > int(params.MaxBlockBytes) {
+			return fmt.Errorf("%w: %d bytes of transactions, the limit is %d", ErrBlockLimit, size, params.MaxBlockBytes)
+		}
+	}
+	return nil
+}
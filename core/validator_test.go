@@ -0,0 +1,129 @@
+package core
+
+import (
+	"myblockchain/crypto"
+	"myblockchain/types"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLimitedChain(t *testing.T, params ConsensusParams) *BlockChain {
+	g := DefaultGenesis()
+	g.Consensus = params
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{}, g)
+	assert.Nil(t, err)
+	return bc
+}
+
+func scriptTx(t *testing.T, bc *BlockChain, code []byte) *Transaction {
+	tx := NewTransaction(code)
+	tx.ChainID = bc.ChainID()
+	assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+	return tx
+}
+
+func TestProposeBlockRespectsLimits(t *testing.T) {
+	small := func(bc *BlockChain) *Transaction { return scriptTx(t, bc, storeCode("a", 1)) }
+
+	bc := newLimitedChain(t, ConsensusParams{MaxBlockTxs: 2})
+	b := mustAdd(t, bc, proposeBlock(t, bc, small(bc), small(bc), small(bc)))
+	assert.Len(t, b.Transactions, 2)
+
+	bc = newLimitedChain(t, ConsensusParams{})
+	tx := small(bc)
+	bc = newLimitedChain(t, ConsensusParams{MaxBlockBytes: uint32(2 * encodedTxSize(tx))})
+	large := scriptTx(t, bc, make([]byte, 100))
+	b = mustAdd(t, bc, proposeBlock(t, bc, small(bc), large, small(bc), small(bc)))
+	assert.Len(t, b.Transactions, 2)
+	for _, tx := range b.Transactions {
+		assert.NotEqual(t, large, tx)
+	}
+
+	// every store costs 8 instructions
+	bc = newLimitedChain(t, ConsensusParams{MaxBlockCost: 20})
+	b = mustAdd(t, bc, proposeBlock(t, bc, small(bc), small(bc), small(bc)))
+	assert.Len(t, b.Transactions, 2)
+	assertStateValue(t, bc.contractState, "a", 1)
+}
+
+func TestValidateBlockLimits(t *testing.T) {
+	priv := crypto.GeneratePrivateKey()
+	unlimited := newLimitedChain(t, ConsensusParams{})
+	txs := []*Transaction{
+		scriptTx(t, unlimited, storeCode("a", 1)),
+		scriptTx(t, unlimited, storeCode("b", 2)),
+	}
+	b, err := unlimited.ProposeBlock(priv, txs)
+	assert.Nil(t, err)
+
+	// the limits are part of the genesis, change them after the fact to
+	// keep the parent of the block
+	for _, params := range []ConsensusParams{
+		{MaxBlockTxs: 1},
+		{MaxBlockBytes: uint32(encodedTxSize(txs[0]))},
+		{MaxBlockCost: 8},
+	} {
+		bc := newLimitedChain(t, ConsensusParams{})
+		bc.genesis.Consensus = params
+		assert.ErrorIs(t, bc.AddBlock(b), ErrBlockLimit)
+		assert.Equal(t, uint32(0), bc.Height())
+	}
+	bc := newLimitedChain(t, ConsensusParams{})
+	bc.genesis.Consensus = ConsensusParams{MaxBlockTxs: 2, MaxBlockBytes: uint32(2 * encodedTxSize(txs[0])), MaxBlockCost: 16}
+	assert.Nil(t, bc.AddBlock(b))
+}
+
+// proposeAt proposes a block with the given timestamp.
+func proposeAt(t *testing.T, bc *BlockChain, priv crypto.PrivateKey, timestamp uint64) *Block {
+	b, err := bc.ProposeBlock(priv, nil)
+	assert.Nil(t, err)
+	b.Timestamp = timestamp
+	b.hash = types.Hash{}
+	assert.Nil(t, b.Sign(priv))
+	return b
+}
+
+func TestValidateTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{Now: func() time.Time { return now }}, DefaultGenesis())
+	assert.Nil(t, err)
+	priv := crypto.GeneratePrivateKey()
+	T := uint64(now.UnixNano())
+
+	b1 := mustAdd(t, bc, proposeBlock(t, bc))
+	assert.Equal(t, T, b1.Timestamp)
+	assert.ErrorIs(t, bc.AddBlock(proposeAt(t, bc, priv, T-1)), ErrTimestamp)
+	future := uint64(now.Add(defaultMaxFutureTime).UnixNano())
+	assert.ErrorIs(t, bc.AddBlock(proposeAt(t, bc, priv, future+1)), ErrFutureBlock)
+	mustAdd(t, bc, proposeAt(t, bc, priv, future))
+
+	// the clock is behind the tip, the proposer still moves forward
+	now = now.Add(time.Second)
+	b3 := mustAdd(t, bc, proposeBlock(t, bc))
+	assert.Equal(t, future+1, b3.Timestamp)
+	// time may not stand still
+	assert.ErrorIs(t, bc.AddBlock(proposeAt(t, bc, priv, b3.Timestamp)), ErrTimestamp)
+	mustAdd(t, bc, proposeAt(t, bc, priv, b3.Timestamp+1))
+}
+
+func TestValidateMedianTime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := DefaultGenesis()
+	g.Consensus.MedianTimeBlocks = 3
+	bc, err := NewBlockChainFromGenesis(BlockChainOptions{Now: func() time.Time { return now }}, g)
+	assert.Nil(t, err)
+	priv := crypto.GeneratePrivateKey()
+	T := uint64(now.UnixNano())
+
+	mustAdd(t, bc, proposeAt(t, bc, priv, T))
+	mustAdd(t, bc, proposeAt(t, bc, priv, T+1))
+	b3 := mustAdd(t, bc, proposeAt(t, bc, priv, T+5))
+	// the median of T+5, T+1 and T is T+1
+	median, err := bc.medianTime(b3.Header, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, T+1, median)
+	assert.ErrorIs(t, bc.AddBlock(proposeAt(t, bc, priv, T+1)), ErrTimestamp)
+	mustAdd(t, bc, proposeAt(t, bc, priv, T+6))
+}
@@ -2,6 +2,9 @@ package core
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"myblockchain/types"
 )
 
 type Instruction byte
@@ -41,11 +44,21 @@ func (s *Stack) Pop() any {
 	return res
 }
 
+var (
+	ErrStackUnderflow = errors.New("stack underflow")
+	ErrStackOverflow  = errors.New("stack overflow")
+)
+
 type VM struct {
 	data          []byte
 	ip            int //instruction pointer
 	stack         Stack
 	contractState *State
+	// the contract the code belongs to, nil for scripts which store into
+	// the shared keyspace
+	contract *types.Address
+	// number of instructions executed
+	cost uint64
 }
 
 func NewVM(data []byte, state *State) *VM {
@@ -57,64 +70,178 @@ func NewVM(data []byte, state *State) *VM {
 	}
 }
 
-func (vm *VM) Run() error {
-	for {
-		instr := vm.data[vm.ip]
+// NewContractVM returns a VM running the code of the contract at the
+// address, which stores into the keyspace of the contract.
+func NewContractVM(code []byte, state *State, addr types.Address) *VM {
+	vm := NewVM(code, state)
+	vm.contract = &addr
+	return vm
+}
 
-		if err := vm.Execute(Instruction(instr)); err != nil {
-			return err
-		}
-		vm.ip++
-		if vm.ip > len(vm.data)-1 {
-			break
+// Run executes the code until the end or the first error. Any malformed
+// code results in an error, never in a panic, so a transaction can be
+// marked as failed deterministically.
+func (vm *VM) Run() error {
+	for ; vm.ip < len(vm.data); vm.ip++ {
+		vm.cost++
+		if err := vm.Execute(Instruction(vm.data[vm.ip])); err != nil {
+			return fmt.Errorf("instruction %d (0x%02x): %w", vm.ip, vm.data[vm.ip], err)
 		}
 	}
 	return nil
 }
 
+// Cost returns the number of instructions executed so far.
+func (vm *VM) Cost() uint64 {
+	return vm.cost
+}
+
+// Result returns the value on top of the stack, nil if the stack is empty.
+func (vm *VM) Result() any {
+	if vm.stack.sp < 0 {
+		return nil
+	}
+	return vm.stack.data[vm.stack.sp]
+}
+
 func (vm *VM) Execute(instr Instruction) error {
-	s := &vm.stack
 	switch instr {
 	case InstrPushInt:
-		s.Push(int(vm.data[vm.ip-1]))
+		v, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		return vm.push(int(v))
 	case InstrAdd:
-		a := s.Pop().(int)
-		b := s.Pop().(int)
-		s.Push(a + b)
+		a, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		b, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		return vm.push(a + b)
 	case InstrPushByte:
-		s.Push(byte(vm.data[vm.ip-1]))
+		v, err := vm.operand()
+		if err != nil {
+			return err
+		}
+		return vm.push(v)
 	case InstrPack:
-		n := s.Pop().(int)
+		n, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		if n < 0 || n > vm.stack.sp+1 {
+			return fmt.Errorf("cannot pack %d bytes: %w", n, ErrStackUnderflow)
+		}
 		b := make([]byte, n)
 		for i := n - 1; i >= 0; i-- { // 倒序弹出，保持字节序
-			b[i] = s.Pop().(byte)
+			if b[i], err = vm.popByte(); err != nil {
+				return err
+			}
 		}
-		s.Push(b)
+		return vm.push(b)
 	case InstrSub:
-		a := vm.stack.Pop().(int)
-		b := vm.stack.Pop().(int)
-		c := b - a
-		vm.stack.Push(c)
+		a, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		b, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		return vm.push(b - a)
 	case InstrStore:
-		var (
-			value           = vm.stack.Pop()
-			key             = vm.stack.Pop().([]byte)
-			serializedValue []byte
-		)
+		value, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		key, err := vm.popBytes()
+		if err != nil {
+			return err
+		}
+		if vm.contract != nil {
+			key = storageKey(*vm.contract, key)
+		} else if isReservedKey(key) {
+			return fmt.Errorf("cannot store reserved key %q", key)
+		}
 
+		var serializedValue []byte
 		switch v := value.(type) {
 		case int:
 			serializedValue = serializeInt64(int64(v))
+		case []byte:
+			serializedValue = v
 		default:
-			panic("TODO: unknown type")
+			return fmt.Errorf("cannot store value of type %T", value)
 		}
-		vm.contractState.Put(key, serializedValue)
+		return vm.contractState.Put(key, serializedValue)
+	}
 
+	return nil
+}
+
+// operand returns the byte in front of the current instruction.
+func (vm *VM) operand() (byte, error) {
+	if vm.ip == 0 {
+		return 0, fmt.Errorf("missing operand")
 	}
+	return vm.data[vm.ip-1], nil
+}
 
+func (vm *VM) push(v any) error {
+	if vm.stack.sp+1 >= len(vm.stack.data) {
+		return ErrStackOverflow
+	}
+	vm.stack.Push(v)
 	return nil
 }
 
+func (vm *VM) pop() (any, error) {
+	if vm.stack.sp < 0 {
+		return nil, ErrStackUnderflow
+	}
+	return vm.stack.Pop(), nil
+}
+
+func (vm *VM) popInt() (int, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	i, ok := v.(int)
+	if !ok {
+		return 0, fmt.Errorf("expected int on the stack, got %T", v)
+	}
+	return i, nil
+}
+
+func (vm *VM) popByte() (byte, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	b, ok := v.(byte)
+	if !ok {
+		return 0, fmt.Errorf("expected byte on the stack, got %T", v)
+	}
+	return b, nil
+}
+
+func (vm *VM) popBytes() ([]byte, error) {
+	v, err := vm.pop()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("expected bytes on the stack, got %T", v)
+	}
+	return b, nil
+}
+
 func serializeInt64(value int64) []byte {
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint64(buf, uint64(value))
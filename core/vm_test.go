@@ -29,3 +29,17 @@ func TestVM(t *testing.T) {
 	vm := NewVM(data, NewState())
 	assert.Nil(t, vm.Run())
 }
+
+func TestVMMalformedCode(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x0a},                         // push without operand
+		{0x0b},                         // add on an empty stack
+		{0x01, 0x0c, 0x0b},             // add on a byte
+		{0x05, 0x0a, 0x0d},             // pack more than on the stack
+		{0x01, 0x0a, 0x01, 0x0a, 0x0f}, // store with an int key
+	} {
+		vm := NewVM(data, NewState())
+		assert.NotNil(t, vm.Run())
+	}
+	assert.Nil(t, NewVM(nil, NewState()).Run())
+}
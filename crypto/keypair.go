@@ -37,8 +37,17 @@ type PrivateKey struct {
 	key *ecdsa.PrivateKey
 }
 
+// digest is what gets signed for data. ECDSA only looks at as many bytes of
+// its input as the curve is long, signing data itself would leave everything
+// past its first 32 bytes unsigned.
+func digest(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// Sign signs the sha256 digest of data.
 func (k PrivateKey) Sign(data []byte) (*Signature, error) {
-	r, s, err := ecdsa.Sign(rand.Reader, k.key, data)
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, digest(data))
 	if err != nil {
 		return nil, err
 	}
@@ -75,14 +84,19 @@ type Signature struct {
 	R, S *big.Int
 }
 
+// Verify reports whether sig is a signature of the sha256 digest of data by
+// the key.
 func (sig Signature) Verify(data []byte, pubKey PublicKey) bool {
 	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), pubKey)
+	if x == nil || sig.R == nil || sig.S == nil {
+		return false
+	}
 	key := &ecdsa.PublicKey{
 		Curve: elliptic.P256(),
 		X:     x,
 		Y:     y,
 	}
-	return ecdsa.Verify(key, data, sig.R, sig.S)
+	return ecdsa.Verify(key, digest(data), sig.R, sig.S)
 }
 
 func (sig Signature) String() string {
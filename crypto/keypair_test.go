@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/ecdsa"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,3 +45,21 @@ func TestKeyPair_Sign_Verify_Fail(t *testing.T) {
 	assert.False(t, signature.Verify(msg, otherPubKey))
 	assert.False(t, signature.Verify([]byte("Hello, Not world!"), privKey.PublicKey()))
 }
+
+func TestSignatureCoversLongMessages(t *testing.T) {
+	privKey := GeneratePrivateKey()
+	msg := make([]byte, 64)
+	signature, err := privKey.Sign(msg)
+	assert.Nil(t, err)
+	msg[63] = 1
+	assert.False(t, signature.Verify(msg, privKey.PublicKey()))
+}
+
+func TestSignatureIsOverTheDigest(t *testing.T) {
+	privKey := GeneratePrivateKey()
+	msg := []byte("Hello, world!")
+	signature, err := privKey.Sign(msg)
+	assert.Nil(t, err)
+	assert.True(t, ecdsa.Verify(&privKey.key.PublicKey, digest(msg), signature.R, signature.S))
+	assert.False(t, ecdsa.Verify(&privKey.key.PublicKey, msg, signature.R, signature.S))
+}
@@ -7,10 +7,17 @@ import (
 	"myblockchain/crypto"
 	"myblockchain/networks"
 	"net"
+	"os"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	privKey := crypto.GeneratePrivateKey()
 	localNode := makeServer("LOCAL_NODE", &privKey, ":3000", []string{":4000"}, "")
@@ -57,14 +64,14 @@ func txSender() {
 	privKey := crypto.GeneratePrivateKey()
 	data := []byte{0x01, 0x0a, 0x02, 0x0a, 0x0b}
 	tx := core.NewTransaction(data)
+	tx.ChainID = core.DefaultGenesis().ChainID
 	tx.Sign(privKey)
 	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+	if err := tx.Encode(core.NewBinaryTxEncoder(buf)); err != nil {
 		panic(err)
 	}
 	msg := networks.NewMessage(networks.MessageTypeTx, buf.Bytes())
-	_, err = conn.Write(msg.Bytes())
-	if err != nil {
+	if err := networks.WriteFrame(conn, msg.Bytes()); err != nil {
 		panic(err)
 	}
 }
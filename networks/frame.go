@@ -0,0 +1,43 @@
+package networks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Messages on a TCP connection are framed: a big endian uint32 holding the
+// length of the message, followed by the message. TCP is a stream, a
+// single read may return part of a message or several of them, so without
+// the length a reader cannot tell where one message ends. Nodes that write
+// bare messages cannot talk to nodes that frame them.
+
+// maxFrameSize bounds the size of a single message on the wire.
+const maxFrameSize = 32 << 20
+
+// WriteFrame writes a message prefixed by its length, so the reader knows
+// where it ends no matter how the stream is split up.
+func WriteFrame(w io.Writer, b []byte) error {
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(b)))
+	copy(buf[4:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a message written by WriteFrame.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size)
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("message of (%d) bytes too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
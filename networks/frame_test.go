@@ -0,0 +1,32 @@
+package networks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFramesSurviveSplitReads(t *testing.T) {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, WriteFrame(buf, []byte("foo")))
+	assert.Nil(t, WriteFrame(buf, []byte{}))
+	assert.Nil(t, WriteFrame(buf, []byte("barbaz")))
+
+	r := iotest.OneByteReader(buf)
+	for _, want := range []string{"foo", "", "barbaz"} {
+		msg, err := ReadFrame(r)
+		assert.Nil(t, err)
+		assert.Equal(t, want, string(msg))
+	}
+	_, err := ReadFrame(r)
+	assert.NotNil(t, err)
+}
+
+func TestReadFrameRejectsOversizedMessages(t *testing.T) {
+	size := binary.BigEndian.AppendUint32(nil, maxFrameSize+1)
+	_, err := ReadFrame(bytes.NewReader(size))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,195 @@
+package networks
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"myblockchain/core"
+	"myblockchain/types"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+var defaultRequestTimeout = 10 * time.Second
+
+// maxSyncBacktrack is how far below its tip a light client looks for the
+// point where its chain and the one of the peer diverged.
+const maxSyncBacktrack = 1024
+
+type LightClientOptions struct {
+	Logger log.Logger
+	// Genesis describes the network to follow, defaults to the default genesis.
+	Genesis *core.Genesis
+	// Peer is the address of the full node headers, blocks and proofs are
+	// requested from.
+	Peer string
+	// RequestTimeout is how long to wait for the answer of the peer.
+	RequestTimeout time.Duration
+}
+
+// LightClient follows the chain by its headers only and fetches blocks and
+// transactions on demand from a full node, checking them against the
+// headers. It holds no blocks, so it can run inside a tool or a wallet.
+type LightClient struct {
+	LightClientOptions
+	chain *core.LightChain
+	conn  net.Conn
+	// one request at a time, answers come back in order
+	lock sync.Mutex
+}
+
+func NewLightClient(opts LightClientOptions) (*LightClient, error) {
+	if opts.Logger == nil {
+		opts.Logger = log.NewLogfmtLogger(os.Stderr)
+	}
+	if opts.Genesis == nil {
+		opts.Genesis = core.DefaultGenesis()
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	chain, err := core.NewLightChain(opts.Logger, opts.Genesis)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", opts.Peer)
+	if err != nil {
+		return nil, err
+	}
+	return &LightClient{
+		LightClientOptions: opts,
+		chain:              chain,
+		conn:               conn,
+	}, nil
+}
+
+// Chain returns the headers the client has synced so far.
+func (c *LightClient) Chain() *core.LightChain {
+	return c.chain
+}
+
+func (c *LightClient) Close() error {
+	return c.conn.Close()
+}
+
+// Sync downloads and validates the headers the peer has beyond our tip and
+// returns the new height.
+func (c *LightClient) Sync() (uint32, error) {
+	from := c.chain.Height() + 1
+	backtrack := uint32(1)
+	for {
+		headers, err := c.getHeaders(from)
+		if err != nil {
+			return c.chain.Height(), err
+		}
+		if len(headers) == 0 {
+			return c.chain.Height(), nil
+		}
+	add:
+		for _, h := range headers {
+			err := c.chain.AddHeader(h)
+			switch {
+			case err == nil, errors.Is(err, core.ErrBlockKnown):
+			case errors.Is(err, core.ErrUnknownParent):
+				// the peer is on another branch, go back until the
+				// headers connect to ours again
+				if backtrack > maxSyncBacktrack || from == 1 {
+					return c.chain.Height(), err
+				}
+				if backtrack >= from {
+					backtrack = from - 1
+				}
+				from -= backtrack
+				backtrack *= 2
+				break add
+			default:
+				return c.chain.Height(), err
+			}
+			from = h.Height + 1
+		}
+		c.Logger.Log("msg", "synced headers", "height", c.chain.Height())
+	}
+}
+
+// GetTransaction fetches a transaction and its proof of inclusion from the
+// peer and checks the proof against the synced headers.
+func (c *LightClient) GetTransaction(hash types.Hash) (*core.Transaction, error) {
+	res := new(TxProofMessage)
+	if err := c.request(MessageTypeGetTxProof, &GetTxProofMessage{Hash: hash}, MessageTypeTxProof, res); err != nil {
+		return nil, err
+	}
+	if len(res.Error) > 0 {
+		return nil, fmt.Errorf("peer cannot prove tx (%s): %s", hash, res.Error)
+	}
+	if res.Proof == nil {
+		return nil, fmt.Errorf("peer sent no proof for tx (%s)", hash)
+	}
+	return c.chain.VerifyTx(hash, res.Proof)
+}
+
+// GetBlock fetches the block at the given height from the peer and checks
+// it against the synced header.
+func (c *LightClient) GetBlock(height uint32) (*core.Block, error) {
+	if height > c.chain.Height() {
+		return nil, fmt.Errorf("given height (%d) too high", height)
+	}
+	res := new(BlocksMessage)
+	if err := c.request(MessageTypeGetBlocks, &GetBlocksMessage{From: height, To: height}, MessageTypeBlocks, res); err != nil {
+		return nil, err
+	}
+	if len(res.Blocks) != 1 {
+		return nil, fmt.Errorf("peer sent (%d) blocks for height (%d)", len(res.Blocks), height)
+	}
+	b := res.Blocks[0]
+	if err := c.chain.VerifyBlock(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *LightClient) getHeaders(from uint32) ([]*core.SignedHeader, error) {
+	res := new(HeadersMessage)
+	if err := c.request(MessageTypeGetHeaders, &GetHeadersMessage{From: from}, MessageTypeHeaders, res); err != nil {
+		return nil, err
+	}
+	return res.Headers, nil
+}
+
+// request sends a message to the peer and decodes its answer into res.
+// Everything else the peer sends in the meantime, like new blocks and
+// transactions it broadcasts, is skipped.
+func (c *LightClient) request(t MessageType, req any, want MessageType, res any) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(req); err != nil {
+		return err
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(c.RequestTimeout)); err != nil {
+		return err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+	if err := WriteFrame(c.conn, NewMessage(t, buf.Bytes()).Bytes()); err != nil {
+		return err
+	}
+	for {
+		frame, err := ReadFrame(c.conn)
+		if err != nil {
+			return err
+		}
+		msg := Message{}
+		if err := gob.NewDecoder(bytes.NewReader(frame)).Decode(&msg); err != nil {
+			return err
+		}
+		if msg.Header != want {
+			continue
+		}
+		return gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(res)
+	}
+}
@@ -0,0 +1,91 @@
+package networks
+
+import (
+	"bytes"
+	"myblockchain/core"
+	"myblockchain/crypto"
+	"net"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// serveLightClients runs the message handling of the server for every
+// connection accepted on a local port and returns its address.
+func serveLightClients(t *testing.T, s *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			peer := &TCPPeer{conn: conn}
+			s.mu.Lock()
+			s.peerMap[conn.RemoteAddr()] = peer
+			s.mu.Unlock()
+			go func() {
+				for {
+					frame, err := ReadFrame(conn)
+					if err != nil {
+						return
+					}
+					msg, err := DefaultRPCDecodeFunc(RPC{From: conn.RemoteAddr(), Payload: bytes.NewReader(frame)})
+					if err != nil {
+						return
+					}
+					s.ProcessMessage(msg)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestLightClientSync(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	g := core.DefaultGenesis()
+	g.Validators = []string{validator.PublicKey().Address().String()}
+	s, err := NewServer(ServerOptions{Genesis: g, Logger: log.NewNopLogger(), DataDir: t.TempDir()})
+	assert.Nil(t, err)
+
+	var included *core.Transaction
+	for i := 0; i < 5; i++ {
+		tx := core.NewTransaction([]byte{byte(i)})
+		tx.ChainID = g.ChainID
+		assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+		b, err := s.chain.ProposeBlock(validator, []*core.Transaction{tx})
+		assert.Nil(t, err)
+		assert.Nil(t, s.chain.AddBlock(b))
+		if i == 2 {
+			included = tx
+		}
+	}
+
+	lc, err := NewLightClient(LightClientOptions{
+		Genesis: g,
+		Peer:    serveLightClients(t, s),
+		Logger:  log.NewNopLogger(),
+	})
+	assert.Nil(t, err)
+	defer lc.Close()
+
+	height, err := lc.Sync()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5), height)
+
+	tx, err := lc.GetTransaction(included.Hash(core.TxHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, included.Data, tx.Data)
+	_, err = lc.GetTransaction(core.TxHasher{}.Hash(core.NewTransaction([]byte("unknown"))))
+	assert.NotNil(t, err)
+
+	b, err := lc.GetBlock(3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), b.Height)
+	_, err = lc.GetBlock(6)
+	assert.NotNil(t, err)
+}
@@ -1,6 +1,9 @@
 package networks
 
-import "myblockchain/core"
+import (
+	"myblockchain/core"
+	"myblockchain/types"
+)
 
 type GetStatusMessage struct{}
 type StatusMessage struct {
@@ -19,3 +22,24 @@ type GetBlocksMessage struct {
 type BlocksMessage struct {
 	Blocks []*core.Block
 }
+
+type GetHeadersMessage struct {
+	From uint32
+	// If To is 0 the maximum headers will be returned.
+	To uint32
+}
+
+type HeadersMessage struct {
+	Headers []*core.SignedHeader
+}
+
+type GetTxProofMessage struct {
+	Hash types.Hash
+}
+
+type TxProofMessage struct {
+	Hash  types.Hash
+	Proof *core.TxProof
+	// Error is set if the transaction is not on the chain.
+	Error string
+}
@@ -15,12 +15,16 @@ import (
 type MessageType byte
 
 const (
-	MessageTypeTx        MessageType = 0x1
-	MessageTypeBlock     MessageType = 0x2
-	MessageTypeGetBlocks MessageType = 0x3
-	MessageTypeStatus    MessageType = 0x4
-	MessageTypeGetStatus MessageType = 0x5
-	MessageTypeBlocks    MessageType = 0x6
+	MessageTypeTx         MessageType = 0x1
+	MessageTypeBlock      MessageType = 0x2
+	MessageTypeGetBlocks  MessageType = 0x3
+	MessageTypeStatus     MessageType = 0x4
+	MessageTypeGetStatus  MessageType = 0x5
+	MessageTypeBlocks     MessageType = 0x6
+	MessageTypeGetHeaders MessageType = 0x7
+	MessageTypeHeaders    MessageType = 0x8
+	MessageTypeGetTxProof MessageType = 0x9
+	MessageTypeTxProof    MessageType = 0xa
 )
 
 type RPC struct {
@@ -64,16 +68,19 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 	switch msg.Header {
 	case MessageTypeTx:
 		tx := new(core.Transaction)
-		if err := tx.Decode(core.NewGobTxDecoder(bytes.NewReader(msg.Data))); err != nil {
+		if err := tx.Decode(core.NewBinaryTxDecoder(bytes.NewReader(msg.Data))); err != nil {
 			return nil, err
 		}
+		if err := tx.Validate(); err != nil {
+			return nil, fmt.Errorf("tx from %s: %w", rpc.From, err)
+		}
 		return &DecodedMessage{
 			From: rpc.From,
 			Data: tx,
 		}, nil
 	case MessageTypeBlock:
 		block := new(core.Block)
-		if err := block.Decode(core.NewGobBlockDecoder(bytes.NewReader(msg.Data))); err != nil {
+		if err := block.Decode(core.NewBinaryBlockDecoder(bytes.NewReader(msg.Data))); err != nil {
 			return nil, err
 		}
 		return &DecodedMessage{
@@ -113,6 +120,42 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 			From: rpc.From,
 			Data: blocks,
 		}, nil
+	case MessageTypeGetHeaders:
+		getHeaders := new(GetHeadersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getHeaders); err != nil {
+			return nil, err
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: getHeaders,
+		}, nil
+	case MessageTypeHeaders:
+		headers := new(HeadersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(headers); err != nil {
+			return nil, err
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: headers,
+		}, nil
+	case MessageTypeGetTxProof:
+		getProof := new(GetTxProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getProof); err != nil {
+			return nil, err
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: getProof,
+		}, nil
+	case MessageTypeTxProof:
+		proof := new(TxProofMessage)
+		if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(proof); err != nil {
+			return nil, err
+		}
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: proof,
+		}, nil
 	default:
 		return nil, fmt.Errorf("invalid message type: %d", msg.Header)
 	}
@@ -3,13 +3,14 @@ package networks
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"myblockchain/api"
 	"myblockchain/core"
 	"myblockchain/crypto"
-	"myblockchain/types"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -18,6 +19,21 @@ import (
 
 var defaultBlockTime = 5 * time.Second
 
+// ErrUnknownPeer is returned for messages to a peer that is not connected,
+// or not anymore.
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// defaultDataDir is where nodes persist their chain, every node in its own
+// directory named after its ID.
+const defaultDataDir = "data"
+
+// maxHeadersPerMessage bounds the headers returned for one request.
+const maxHeadersPerMessage = 2000
+
+// maxBlocksPerMessage bounds the blocks returned for one request, a peer
+// that gets a full page asks for the next one.
+const maxBlocksPerMessage = 64
+
 type ServerOptions struct {
 	APIListenAddr string
 	SeedNodes     []string
@@ -30,11 +46,28 @@ type ServerOptions struct {
 	// Transports    []Transport
 	BlockTime  time.Duration
 	PrivateKey *crypto.PrivateKey
+	// DataDir is where the chain is persisted, defaults to data/<ID>. The
+	// node keeps no blocks in memory beyond a small cache, but the indexes
+	// of the block and transaction hashes grow with the chain, see
+	// core.FileStore.
+	DataDir string
+	// Genesis describes the network to join. If nil it is loaded from
+	// GenesisFile, or the default genesis is used when that is empty too.
+	Genesis     *core.Genesis
+	GenesisFile string
+	// TxMaxAge is how long a transaction stays in the mempool without being
+	// included, defaults to an hour.
+	TxMaxAge time.Duration
+	// StateHistory and Archive control for how many blocks the state can be
+	// read back, see core.BlockChainOptions.
+	StateHistory uint32
+	Archive      bool
 }
 type Server struct {
 	ServerOptions
 	TCPTransport *TCPTransport
 	peerCh       chan *TCPPeer
+	delPeerCh    chan *TCPPeer
 	peerMap      map[net.Addr]*TCPPeer
 	mu           sync.RWMutex
 	chain        *core.BlockChain
@@ -45,6 +78,19 @@ type Server struct {
 }
 
 func NewServer(opts ServerOptions) (*Server, error) {
+	if opts.Genesis == nil {
+		opts.Genesis = core.DefaultGenesis()
+		if len(opts.GenesisFile) > 0 {
+			g, err := core.LoadGenesis(opts.GenesisFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.Genesis = g
+		}
+	}
+	if opts.BlockTime == time.Duration(0) {
+		opts.BlockTime = time.Duration(opts.Genesis.Consensus.BlockTime)
+	}
 	if opts.BlockTime == time.Duration(0) {
 		opts.BlockTime = defaultBlockTime
 	}
@@ -55,8 +101,22 @@ func NewServer(opts ServerOptions) (*Server, error) {
 		opts.Logger = log.NewLogfmtLogger(os.Stderr)
 		opts.Logger = log.With(opts.Logger, "ID", opts.ID)
 	}
-	chain, err := core.NewBlockChain(opts.Logger, genesisBlock())
+	chainOpts := core.BlockChainOptions{
+		Logger:       opts.Logger,
+		StateHistory: opts.StateHistory,
+		Archive:      opts.Archive,
+	}
+	if len(opts.DataDir) == 0 {
+		opts.DataDir = filepath.Join(defaultDataDir, opts.ID)
+	}
+	store, err := core.NewFileStore(opts.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	chainOpts.Store = store
+	chain, err := core.NewBlockChainFromGenesis(chainOpts, opts.Genesis)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
@@ -77,14 +137,17 @@ func NewServer(opts ServerOptions) (*Server, error) {
 		ServerOptions: opts,
 		TCPTransport:  tr,
 		peerCh:        peerCh,
+		delPeerCh:     make(chan *TCPPeer),
 		peerMap:       make(map[net.Addr]*TCPPeer),
-		mempool:       NewTxPool(1000),
+		mempool:       newMempool(opts.TxMaxAge),
 		isValidator:   opts.PrivateKey != nil,
 		chain:         chain,
 		rpcch:         make(chan RPC),
 		quitch:        make(chan struct{}, 1),
 	}
 
+	chain.Handle(s.handleChainEvent)
+
 	s.TCPTransport.peerCh = peerCh
 	if s.RPCProcessor == nil {
 		s.RPCProcessor = s
@@ -110,13 +173,18 @@ free:
 	for {
 		select {
 		case peer := <-s.peerCh:
+			s.mu.Lock()
 			s.peerMap[peer.conn.RemoteAddr()] = peer
-			go peer.readLoop(s.rpcch)
+			s.mu.Unlock()
+			go peer.readLoop(s.rpcch, s.delPeerCh)
 			if err := s.sendGetStatusMessage(peer); err != nil {
 				s.Logger.Log("err", err)
 				continue
 			}
 			s.Logger.Log("msg", "peer added to the server", "outgoing", peer.Outgoing, "addr", peer.conn.RemoteAddr())
+		case peer := <-s.delPeerCh:
+			s.removePeer(peer)
+			s.Logger.Log("msg", "peer removed from the server", "addr", peer.conn.RemoteAddr())
 		case rpc := <-s.rpcch:
 			msg, err := s.RPCDecodeFunc(rpc)
 			if err != nil {
@@ -136,6 +204,33 @@ free:
 	s.Logger.Log("msg", "Server is shutting down")
 }
 
+// removePeer forgets the peer, unless its address was taken over by a new
+// connection in the meantime.
+func (s *Server) removePeer(peer *TCPPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := peer.conn.RemoteAddr()
+	if s.peerMap[addr] == peer {
+		delete(s.peerMap, addr)
+	}
+}
+
+// handleChainEvent keeps the mempool in line with the chain. Transactions
+// of blocks that join the chain leave the mempool, those of blocks that
+// left the canonical chain go back into it so they can be included again.
+// It runs while the block is added, so no transaction is lost to a full
+// subscription buffer.
+func (s *Server) handleChainEvent(e core.Event) {
+	switch t := e.(type) {
+	case core.BlockAddedEvent:
+		s.mempool.RemoveIncluded(t.Block.Transactions)
+	case core.ReorgEvent:
+		for _, tx := range t.Reorg.Dropped {
+			s.mempool.Add(tx)
+		}
+	}
+}
+
 func (s *Server) validatorLoop() {
 	ticker := time.NewTicker(s.ServerOptions.BlockTime)
 	s.Logger.Log("msg", "Validator loop started", "blockTime", s.ServerOptions.BlockTime)
@@ -160,6 +255,10 @@ func (s *Server) ProcessMessage(msg *DecodedMessage) error {
 		return s.processGetBlocksMessage(msg.From, t)
 	case *BlocksMessage:
 		return s.processBlocksMessage(msg.From, t)
+	case *GetHeadersMessage:
+		return s.processGetHeadersMessage(msg.From, t)
+	case *GetTxProofMessage:
+		return s.processGetTxProofMessage(msg.From, t)
 	}
 	return nil
 
@@ -171,43 +270,85 @@ func (s *Server) processBlocksMessage(from net.Addr, data *BlocksMessage) error
 	for _, block := range data.Blocks {
 		// fmt.Printf("BlOCK with %+v\n", block.Header)
 		if err := s.chain.AddBlock(block); err != nil {
-			fmt.Printf("adding block error %s\n", err)
+			s.Logger.Log("msg", "block rejected", "height", block.Height, "from", from, "err", err)
 			continue
 		}
 	}
+	// a full page means the peer has more
+	if len(data.Blocks) == maxBlocksPerMessage {
+		return s.sendMessage(from, MessageTypeGetBlocks, &GetBlocksMessage{From: s.chain.Height() + 1})
+	}
 	return nil
 }
 
 func (s *Server) processGetBlocksMessage(from net.Addr, data *GetBlocksMessage) error {
-	var (
-		blocks    = []*core.Block{}
-		ourHeight = s.chain.Height()
-	)
-	if data.To == 0 {
-		for i := int(data.From); i <= int(ourHeight); i++ {
-			block, err := s.chain.GetBlock(uint32(i))
-			if err != nil {
-				return err
-			}
-			blocks = append(blocks, block)
+	ourHeight := s.chain.Height()
+	blocks := []*core.Block{}
+	if data.From <= ourHeight {
+		to := data.From + maxBlocksPerMessage - 1
+		if data.To != 0 && data.To < to {
+			to = data.To
+		}
+		if to > ourHeight {
+			to = ourHeight
+		}
+		if err := s.chain.RangeBlocks(data.From, to, func(b *core.Block) error {
+			blocks = append(blocks, b)
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
-	// fmt.Printf("%+v\n", blocks[0].Header)
-	blocksMsg := &BlocksMessage{
-		Blocks: blocks,
+	return s.sendMessage(from, MessageTypeBlocks, &BlocksMessage{Blocks: blocks})
+}
+
+// processGetHeadersMessage serves the signed headers light clients follow
+// the chain with.
+func (s *Server) processGetHeadersMessage(from net.Addr, data *GetHeadersMessage) error {
+	ourHeight := s.chain.Height()
+	headers := []*core.SignedHeader{}
+	if data.From <= ourHeight {
+		to := data.From + maxHeadersPerMessage - 1
+		if data.To != 0 && data.To < to {
+			to = data.To
+		}
+		if to > ourHeight {
+			to = ourHeight
+		}
+		if err := s.chain.RangeBlocks(data.From, to, func(b *core.Block) error {
+			headers = append(headers, b.SignedHeader())
+			return nil
+		}); err != nil {
+			return err
+		}
 	}
+	return s.sendMessage(from, MessageTypeHeaders, &HeadersMessage{Headers: headers})
+}
+
+func (s *Server) processGetTxProofMessage(from net.Addr, data *GetTxProofMessage) error {
+	msg := &TxProofMessage{Hash: data.Hash}
+	proof, err := s.chain.GetTxProof(data.Hash)
+	if err != nil {
+		msg.Error = err.Error()
+	} else {
+		msg.Proof = proof
+	}
+	return s.sendMessage(from, MessageTypeTxProof, msg)
+}
+
+// sendMessage gob encodes the message and sends it to the given peer.
+func (s *Server) sendMessage(to net.Addr, t MessageType, data any) error {
 	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(blocksMsg); err != nil {
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
 		return err
 	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	msg := NewMessage(MessageTypeBlocks, buf.Bytes())
-	peer, ok := s.peerMap[from]
+	peer, ok := s.peerMap[to]
 	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
+		return fmt.Errorf("%w: %s", ErrUnknownPeer, to)
 	}
-	return peer.Send(msg.Bytes())
+	return peer.Send(NewMessage(t, buf.Bytes()).Bytes())
 }
 
 func (s *Server) ProcessTransaction(tx *core.Transaction) error {
@@ -215,9 +356,24 @@ func (s *Server) ProcessTransaction(tx *core.Transaction) error {
 	if s.mempool.Contains(hash) {
 		return nil
 	}
+	if tx.ChainID != s.chain.ChainID() {
+		return fmt.Errorf("%w: tx (%s) is for chain %d", core.ErrWrongChain, hash, tx.ChainID)
+	}
+	if tx.Expired(s.chain.Height()+1, uint64(time.Now().UnixNano())) {
+		return fmt.Errorf("%w: tx (%s)", core.ErrTxExpired, hash)
+	}
 	if err := tx.Verify(); err != nil {
 		return err
 	}
+	// transactions the chain has already seen the nonce of can never be
+	// included
+	account, err := s.chain.GetAccount(tx.From.Address())
+	if err != nil {
+		return err
+	}
+	if tx.Nonce < account.Nonce {
+		return fmt.Errorf("%w: tx (%s) has nonce %d, account is at %d", core.ErrBadNonce, hash, tx.Nonce, account.Nonce)
+	}
 
 	// s.Logger.Log("msg", "Adding new transaction to mempool", "hash", hash, "mempool pending", s.mempool.PendingCount())
 
@@ -231,7 +387,10 @@ func (s *Server) ProcessBlock(b *core.Block) error {
 		return err
 	}
 	if err := s.chain.AddBlock(b); err != nil {
-		return err
+		if errors.Is(err, core.ErrFutureBlock) {
+			s.Logger.Log("msg", "block from the future, check the clocks", "height", b.Height, "err", err)
+		}
+		return fmt.Errorf("block (%d) rejected: %w", b.Height, err)
 	}
 
 	go s.broadcastBlock(b)
@@ -245,18 +404,7 @@ func (s *Server) processGetStatusMessage(from net.Addr) error {
 		CurrentHeight: s.chain.Height(),
 		ID:            s.ID,
 	}
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(statusMessage); err != nil {
-		return err
-	}
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	peer, ok := s.peerMap[from]
-	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
-	}
-	msg := NewMessage(MessageTypeStatus, buf.Bytes())
-	return peer.Send(msg.Bytes())
+	return s.sendMessage(from, MessageTypeStatus, statusMessage)
 }
 
 func (s *Server) ProcessStatusMessage(from net.Addr, data *StatusMessage) error {
@@ -269,8 +417,11 @@ func (s *Server) ProcessStatusMessage(from net.Addr, data *StatusMessage) error
 	return nil
 }
 
-func (s *Server) requestBlocksLoop(peer net.Addr) error {
+// requestBlocksLoop keeps asking the peer for the blocks above our tip
+// until the peer goes away.
+func (s *Server) requestBlocksLoop(from net.Addr) error {
 	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
 	for {
 		ourHeight := s.chain.Height()
 		s.Logger.Log("msg", "requesting new blocks", "requesting height", ourHeight+1)
@@ -279,19 +430,11 @@ func (s *Server) requestBlocksLoop(peer net.Addr) error {
 			From: ourHeight + 1,
 			To:   0,
 		}
-		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(getBlocksMessage); err != nil {
-			return err
-		}
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-		msg := NewMessage(MessageTypeGetBlocks, buf.Bytes())
-		peer, ok := s.peerMap[peer]
-		if !ok {
-			return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
-		}
-		if err := peer.Send(msg.Bytes()); err != nil {
-			s.Logger.Log("error", "failed to send to peer", "err", err, "peer", peer)
+		if err := s.sendMessage(from, MessageTypeGetBlocks, getBlocksMessage); err != nil {
+			if errors.Is(err, ErrUnknownPeer) {
+				return err
+			}
+			s.Logger.Log("error", "failed to send to peer", "err", err, "peer", from)
 		}
 		<-ticker.C
 	}
@@ -322,7 +465,7 @@ func (s *Server) broadcast(payload []byte) error {
 
 func (s *Server) broadcastBlock(b *core.Block) error {
 	buf := &bytes.Buffer{}
-	if err := b.Encode(core.NewGobBlockEncoder(buf)); err != nil {
+	if err := b.Encode(core.NewBinaryBlockEncoder(buf)); err != nil {
 		return err
 	}
 	msg := NewMessage(MessageTypeBlock, buf.Bytes())
@@ -331,35 +474,38 @@ func (s *Server) broadcastBlock(b *core.Block) error {
 
 func (s *Server) broadcastTransactions(tx *core.Transaction) error {
 	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+	if err := tx.Encode(core.NewBinaryTxEncoder(buf)); err != nil {
 		return err
 	}
 	msg := NewMessage(MessageTypeTx, buf.Bytes())
 	return s.broadcast(msg.Bytes())
 }
 
-func (s *Server) createNewBlock() error {
-	curHeader, err := s.chain.GetHeader(s.chain.Height())
-	if err != nil {
-		return err
+func newMempool(maxAge time.Duration) *TxPool {
+	pool := NewTxPool(1000)
+	if maxAge > 0 {
+		pool.maxAge = maxAge
 	}
+	return pool
+}
 
+func (s *Server) createNewBlock() error {
+	if n := s.mempool.Prune(s.chain.Height() + 1); n > 0 {
+		s.Logger.Log("msg", "dropped expired transactions", "count", n)
+	}
 	txx := s.mempool.Pending()
 
-	block, err := core.NewBlockFromHeader(curHeader, txx)
+	block, err := s.chain.ProposeBlock(*s.PrivateKey, txx)
 	if err != nil {
 		return err
 	}
 
-	if err := block.Sign(*s.PrivateKey); err != nil {
-		return err
-	}
-
 	if err := s.chain.AddBlock(block); err != nil {
 		return err
 	}
 
-	s.mempool.ClearPending()
+	// whatever did not fit stays pending for the next block
+	s.mempool.RemoveIncluded(block.Transactions)
 
 	go s.broadcastBlock(block)
 
@@ -377,21 +523,6 @@ func (s *Server) createNewBlock() error {
 // 	}
 // }
 
-func genesisBlock() *core.Block {
-	header := &core.Header{
-		Version:   1,
-		DataHash:  types.Hash{},
-		Height:    0,
-		Timestamp: 000000,
-	}
-	b := core.NewBlock(header, nil)
-	privKey := crypto.GeneratePrivateKey()
-	if err := b.Sign(privKey); err != nil {
-		panic(err)
-	}
-	return b
-}
-
 func (s *Server) bootstrapNetwork() {
 	for _, addr := range s.SeedNodes {
 		fmt.Println("trying to connect to ", addr)
@@ -0,0 +1,52 @@
+package networks
+
+import (
+	"bytes"
+	"myblockchain/core"
+	"myblockchain/crypto"
+	"net"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBlocksIsPaged(t *testing.T) {
+	validator := crypto.GeneratePrivateKey()
+	g := core.DefaultGenesis()
+	g.Validators = []string{validator.PublicKey().Address().String()}
+	s, err := NewServer(ServerOptions{Genesis: g, Logger: log.NewNopLogger(), DataDir: t.TempDir()})
+	assert.Nil(t, err)
+	for i := 0; i < maxBlocksPerMessage+6; i++ {
+		b, err := s.chain.ProposeBlock(validator, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer remote.Close()
+	conn, err := ln.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+	s.peerMap[conn.RemoteAddr()] = &TCPPeer{conn: conn}
+
+	getBlocks := func(from uint32) []*core.Block {
+		assert.Nil(t, s.processGetBlocksMessage(conn.RemoteAddr(), &GetBlocksMessage{From: from}))
+		frame, err := ReadFrame(remote)
+		assert.Nil(t, err)
+		msg, err := DefaultRPCDecodeFunc(RPC{Payload: bytes.NewReader(frame)})
+		assert.Nil(t, err)
+		return msg.Data.(*BlocksMessage).Blocks
+	}
+	page := getBlocks(1)
+	assert.Len(t, page, maxBlocksPerMessage)
+	assert.Equal(t, uint32(1), page[0].Height)
+	page = getBlocks(maxBlocksPerMessage + 1)
+	assert.Len(t, page, 6)
+	assert.Equal(t, s.chain.Height(), page[5].Height)
+	assert.Empty(t, getBlocks(s.chain.Height()+1))
+}
@@ -5,26 +5,34 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 type TCPPeer struct {
 	conn     net.Conn
 	Outgoing bool
+	// guards the connection, frames of concurrent sends must not interleave
+	lock sync.Mutex
 }
 
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.conn.Write(b)
-	return err
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return WriteFrame(p.conn, b)
 }
-func (p *TCPPeer) readLoop(rpcCh chan RPC) {
-	buf := make([]byte, 2048)
+
+// readLoop hands every message of the peer to rpcCh. Once the connection
+// fails it is closed and the peer goes to delPeerCh, so the server forgets
+// about it.
+func (p *TCPPeer) readLoop(rpcCh chan RPC, delPeerCh chan *TCPPeer) {
 	for {
-		n, err := p.conn.Read(buf)
+		msg, err := ReadFrame(p.conn)
 		if err != nil {
-			fmt.Printf("read error: %s", err)
-			continue
+			fmt.Printf("read error from %s: %s\n", p.conn.RemoteAddr(), err)
+			p.conn.Close()
+			delPeerCh <- p
+			return
 		}
-		msg := buf[:n]
 		rpcCh <- RPC{
 			From:    p.conn.RemoteAddr(),
 			Payload: bytes.NewReader(msg),
@@ -0,0 +1,82 @@
+package networks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerRemovedOnReadError(t *testing.T) {
+	s, err := NewServer(ServerOptions{Logger: log.NewNopLogger(), DataDir: t.TempDir()})
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	conn, err := ln.Accept()
+	assert.Nil(t, err)
+
+	peer := &TCPPeer{conn: conn}
+	s.peerMap[conn.RemoteAddr()] = peer
+	go peer.readLoop(s.rpcch, s.delPeerCh)
+	remote.Close()
+
+	select {
+	case dead := <-s.delPeerCh:
+		assert.Equal(t, peer, dead)
+		s.removePeer(dead)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not reported after its connection failed")
+	}
+	assert.Empty(t, s.peerMap)
+
+	// a new connection from the same address is kept
+	other := &TCPPeer{conn: conn}
+	s.peerMap[conn.RemoteAddr()] = other
+	s.removePeer(peer)
+	assert.Equal(t, other, s.peerMap[conn.RemoteAddr()])
+}
+
+func TestSyncLoopReleasesPeers(t *testing.T) {
+	s, err := NewServer(ServerOptions{Logger: log.NewNopLogger(), DataDir: t.TempDir()})
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	remote, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+	conn, err := ln.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	peer := &TCPPeer{conn: conn}
+	s.peerMap[conn.RemoteAddr()] = peer
+	go s.requestBlocksLoop(conn.RemoteAddr())
+	time.Sleep(100 * time.Millisecond)
+
+	// the loop does not hold on to the peers between its requests
+	removed := make(chan struct{})
+	go func() {
+		s.removePeer(peer)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("removing a peer waited for the sync loop")
+	}
+
+	// messages to a peer that is gone fail instead of panicking
+	err = s.requestBlocksLoop(conn.RemoteAddr())
+	assert.ErrorIs(t, err, ErrUnknownPeer)
+	assert.ErrorIs(t, s.processGetStatusMessage(conn.RemoteAddr()), ErrUnknownPeer)
+}
@@ -4,14 +4,21 @@ import (
 	"myblockchain/core"
 	"myblockchain/types"
 	"sync"
+	"time"
 )
 
+var defaultTxMaxAge = time.Hour
+
 type TxPool struct {
 	all     *TxSortedMap
 	pending *TxSortedMap
 	// The maxLength of the total pool of transactions.
 	// When the pool is full we will prune the oldest transaction.
 	maxLength int
+	// maxAge is how long a transaction may wait to be included before it
+	// is dropped.
+	maxAge time.Duration
+	now    func() time.Time
 }
 
 func NewTxPool(maxLength int) *TxPool {
@@ -19,10 +26,16 @@ func NewTxPool(maxLength int) *TxPool {
 		all:       NewTxSortedMap(),
 		pending:   NewTxSortedMap(),
 		maxLength: maxLength,
+		maxAge:    defaultTxMaxAge,
+		now:       time.Now,
 	}
 }
 
 func (p *TxPool) Add(tx *core.Transaction) {
+	if tx.FirstSeen() == 0 {
+		tx.SetFirstSeen(p.now().UnixNano())
+	}
+
 	// prune the oldest transaction that is sitting in the all pool
 	if p.all.Count() == p.maxLength {
 		oldest := p.all.First()
@@ -41,7 +54,39 @@ func (p *TxPool) Contains(hash types.Hash) bool {
 
 // Pending returns a slice of transactions that are in the pending pool
 func (p *TxPool) Pending() []*core.Transaction {
-	return p.pending.txx.Data
+	p.pending.lock.RLock()
+	defer p.pending.lock.RUnlock()
+	return append([]*core.Transaction{}, p.pending.txx.Data...)
+}
+
+// RemoveIncluded removes the transactions of a block from the pool. They
+// can be added again if the block leaves the chain.
+func (p *TxPool) RemoveIncluded(txx []*core.Transaction) {
+	for _, tx := range txx {
+		hash := tx.Hash(core.TxHasher{})
+		if p.all.Contains(hash) {
+			p.all.Remove(hash)
+		}
+		if p.pending.Contains(hash) {
+			p.pending.Remove(hash)
+		}
+	}
+}
+
+// Prune drops the transactions that expired for the block at the given
+// height and those that waited longer than the max age, and returns how
+// many were dropped.
+func (p *TxPool) Prune(height uint32) int {
+	now := p.now()
+	oldest := now.Add(-p.maxAge).UnixNano()
+	expired := []*core.Transaction{}
+	for _, tx := range p.Pending() {
+		if tx.Expired(height, uint64(now.UnixNano())) || tx.FirstSeen() < oldest {
+			expired = append(expired, tx)
+		}
+	}
+	p.RemoveIncluded(expired)
+	return len(expired)
 }
 
 func (p *TxPool) ClearPending() {
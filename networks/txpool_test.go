@@ -4,6 +4,7 @@ import (
 	"myblockchain/core"
 	"myblockchain/util"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -57,6 +58,50 @@ func TestTxPoolMaxLength(t *testing.T) {
 	}
 }
 
+func TestTxPoolRemoveIncluded(t *testing.T) {
+	p := NewTxPool(10)
+	included := util.NewRandomTransaction(100)
+	left := util.NewRandomTransaction(100)
+	p.Add(included)
+	p.Add(left)
+
+	p.RemoveIncluded([]*core.Transaction{included, util.NewRandomTransaction(10)})
+	assert.Equal(t, []*core.Transaction{left}, p.Pending())
+	assert.False(t, p.Contains(included.Hash(core.TxHasher{})))
+
+	// back after a reorg
+	p.Add(included)
+	assert.Equal(t, 2, p.PendingCount())
+}
+
+func TestTxPoolPrune(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	p := NewTxPool(10)
+	p.maxAge = time.Minute
+	p.now = func() time.Time { return now }
+
+	byHeight := util.NewRandomTransaction(10)
+	byHeight.ValidUntilHeight = 5
+	old := util.NewRandomTransaction(10)
+	p.Add(old)
+	now = now.Add(30 * time.Second)
+	byTime := util.NewRandomTransaction(10)
+	byTime.ValidUntilTime = uint64(now.Add(time.Second).UnixNano())
+	fresh := util.NewRandomTransaction(10)
+	for _, tx := range []*core.Transaction{byHeight, byTime, fresh} {
+		p.Add(tx)
+	}
+
+	assert.Equal(t, 0, p.Prune(5))
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, 2, p.Prune(6))
+	assert.Equal(t, []*core.Transaction{old, fresh}, p.Pending())
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 1, p.Prune(6))
+	assert.Equal(t, []*core.Transaction{fresh}, p.Pending())
+	assert.False(t, p.Contains(old.Hash(core.TxHasher{})))
+}
+
 func TestTxSortedMapFirst(t *testing.T) {
 	m := NewTxSortedMap()
 	first := util.NewRandomTransaction(100)
@@ -0,0 +1,74 @@
+package types
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU is a fixed size cache that evicts the least recently used entry
+// once it is full.
+type LRU[K comparable, V any] struct {
+	lock  sync.Mutex
+	size  int
+	items map[K]*list.Element
+	order *list.List
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func NewLRU[K comparable, V any](size int) *LRU[K, V] {
+	if size < 1 {
+		size = 1
+	}
+	return &LRU[K, V]{
+		size:  size,
+		items: make(map[K]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (c *LRU[K, V]) Get(k K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).value, true
+}
+
+func (c *LRU[K, V]) Add(k K, v V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[k]; ok {
+		el.Value.(*lruEntry[K, V]).value = v
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.order.PushFront(&lruEntry[K, V]{key: k, value: v})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+func (c *LRU[K, V]) Remove(k K) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.items[k]; ok {
+		c.order.Remove(el)
+		delete(c.items, k)
+	}
+}
+
+func (c *LRU[K, V]) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
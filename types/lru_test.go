@@ -0,0 +1,46 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUAddGet(t *testing.T) {
+	c := NewLRU[int, string](10)
+	for i := 0; i < 10; i++ {
+		c.Add(i, "foo")
+		v, ok := c.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, "foo", v)
+	}
+	assert.Equal(t, 10, c.Len())
+	_, ok := c.Get(11)
+	assert.False(t, ok)
+}
+
+func TestLRUEvict(t *testing.T) {
+	c := NewLRU[int, int](3)
+	c.Add(1, 1)
+	c.Add(2, 2)
+	c.Add(3, 3)
+	// touch 1 so 2 becomes the least recently used
+	c.Get(1)
+	c.Add(4, 4)
+	assert.Equal(t, 3, c.Len())
+	_, ok := c.Get(2)
+	assert.False(t, ok)
+	_, ok = c.Get(1)
+	assert.True(t, ok)
+}
+
+func TestLRURemove(t *testing.T) {
+	c := NewLRU[string, int](3)
+	c.Add("a", 1)
+	c.Add("a", 2)
+	assert.Equal(t, 1, c.Len())
+	v, _ := c.Get("a")
+	assert.Equal(t, 2, v)
+	c.Remove("a")
+	assert.Equal(t, 0, c.Len())
+}